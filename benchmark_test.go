@@ -22,3 +22,77 @@ func BenchmarkLoad(b *testing.B) {
 		}
 	}
 }
+
+// Benchmarks Get on values with expressions with lazy and eager expansion.
+func BenchmarkGetExpand(b *testing.B) {
+	input := "base=value\n"
+	for i := 0; i < 1000; i++ {
+		input += fmt.Sprintf("key%d=${base}/%d\n", i, i)
+	}
+	for _, expandOnLoad := range []bool{false, true} {
+		b.Run(fmt.Sprintf("expand_on_load_%v", expandOnLoad), func(b *testing.B) {
+			l := &Loader{Encoding: UTF8, ExpandOnLoad: expandOnLoad}
+			p, err := l.LoadBytes([]byte(input))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Get("key500")
+			}
+		})
+	}
+}
+
+// Benchmarks reading the binary form compared to parsing the text form.
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	input := ""
+	for i := 0; i < 1000; i++ {
+		input += fmt.Sprintf("# comment %d\nkey%d=value%d\n", i, i, i)
+	}
+	p, err := LoadString(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("text", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := LoadString(input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := NewProperties().UnmarshalBinary(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Benchmarks Get on a deeply nested expression with and without the expansion cache.
+func BenchmarkGetExpansionCache(b *testing.B) {
+	input := "key0=value\n"
+	for i := 1; i < 50; i++ {
+		input += fmt.Sprintf("key%d=${key%d}/%d\n", i, i-1, i)
+	}
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache_%v", cache), func(b *testing.B) {
+			p, err := LoadString(input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if cache {
+				p.EnableExpansionCache()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Get("key49")
+			}
+		})
+	}
+}
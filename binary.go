@@ -0,0 +1,173 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// binaryHeader identifies the binary format and its version. Version 2
+// adds the comments after the last key and whether they are preceded by
+// an empty line.
+const (
+	binaryHeader   = "PROPS\x02"
+	binaryHeaderV1 = "PROPS\x01"
+)
+
+// errInvalidBinary is returned by UnmarshalBinary for malformed data.
+var errInvalidBinary = errors.New("properties: invalid binary data")
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface. It
+// returns a compact binary form of the keys in order with their
+// unexpanded values and comments followed by the comments after the last
+// key which can be read with UnmarshalBinary faster than the text form can
+// be parsed. Settings like Prefix and Postfix are not stored.
+func (p *Properties) MarshalBinary() ([]byte, error) {
+	p.resolve()
+	buf := []byte(binaryHeader)
+	buf = binary.AppendUvarint(buf, uint64(len(p.k)))
+	for _, k := range p.k {
+		buf = appendBinaryString(buf, p.name(k))
+		buf = appendBinaryString(buf, p.m[k])
+		buf = appendBinaryStrings(buf, p.c[k])
+	}
+	blank := uint64(0)
+	if p.trailingBlank {
+		blank = 1
+	}
+	buf = binary.AppendUvarint(buf, blank)
+	buf = appendBinaryStrings(buf, p.trailingComments)
+	return buf, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. It
+// replaces the keys, values and comments of p with the ones from data which
+// must have been created by MarshalBinary. Data of the first version of
+// the format without the comments after the last key is accepted as well.
+// The settings of p are kept. If
+// data is malformed or contains a circular reference or a malformed
+// expression p remains unchanged and an error is returned.
+func (p *Properties) UnmarshalBinary(data []byte) error {
+	p.resolve()
+	if len(data) < len(binaryHeader) {
+		return errInvalidBinary
+	}
+	header := string(data[:len(binaryHeader)])
+	if header != binaryHeader && header != binaryHeaderV1 {
+		return errInvalidBinary
+	}
+	d := binaryDecoder{data: data[len(binaryHeader):]}
+
+	pp := *p
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		return errInvalidBinary
+	}
+	pp.m = make(map[string]string, n)
+	pp.c = map[string][]string{}
+	pp.cc = nil
+	pp.k = make([]string, 0, n)
+	pp.names = nil
+	pp.sources = nil
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		name, value, comments := d.string(), d.string(), d.strings()
+		k := pp.normKey(name)
+		if _, ok := pp.m[k]; !ok {
+			pp.k = append(pp.k, k)
+			pp.setName(k, name)
+		}
+		pp.m[k] = value
+		if comments != nil {
+			pp.c[k] = comments
+		}
+	}
+	pp.trailingComments, pp.trailingCommentChars, pp.trailingBlank = nil, nil, false
+	if header != binaryHeaderV1 {
+		blank := d.uvarint()
+		if blank > 1 {
+			return errInvalidBinary
+		}
+		pp.trailingBlank = blank == 1
+		pp.trailingComments = d.strings()
+	}
+	if d.err != nil || len(d.data) > 0 {
+		return errInvalidBinary
+	}
+	if !pp.DisableExpansion {
+		if err := pp.check(); err != nil {
+			return err
+		}
+	}
+	pp.dirty = true
+	*p = pp
+	p.invalidate()
+	return nil
+}
+
+// appendBinaryString appends the length prefixed string s to buf.
+func appendBinaryString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendBinaryStrings appends the number of strings followed by the length
+// prefixed strings to buf.
+func appendBinaryStrings(buf []byte, s []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	for _, v := range s {
+		buf = appendBinaryString(buf, v)
+	}
+	return buf
+}
+
+// binaryDecoder reads the values written by MarshalBinary. After the
+// first error all reads return zero values.
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errInvalidBinary
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.err = errInvalidBinary
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// strings reads the strings written by appendBinaryStrings. It returns nil
+// if there are no strings.
+func (d *binaryDecoder) strings() []string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errInvalidBinary
+		return nil
+	}
+	var s []string
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s = append(s, d.string())
+	}
+	return s
+}
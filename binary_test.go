@@ -0,0 +1,81 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"encoding"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*Properties)(nil)
+	_ encoding.BinaryUnmarshaler = (*Properties)(nil)
+)
+
+func TestMarshalBinary(t *testing.T) {
+	input := "# c1\n# c2\nkey = value\nkey⌘ = ${key}/ä\n#\nempty =\nlast = x\\ny"
+	p := mustParse(t, input)
+	data, err := p.MarshalBinary()
+	assert.Equal(t, err, nil)
+
+	pp := NewProperties()
+	pp.MustSet("old", "value")
+	assert.Equal(t, pp.UnmarshalBinary(data), nil)
+	assert.Equal(t, pp.Keys(), []string{"key", "key⌘", "empty", "last"})
+	assert.Equal(t, pp.Map(), p.Map())
+	assert.Equal(t, pp.MustGet("key⌘"), "value/ä")
+	assert.Equal(t, pp.GetComments("key"), []string{"c1", "c2"})
+	assert.Equal(t, pp.GetComments("empty"), []string{""})
+	assert.Equal(t, pp.GetComments("last"), []string(nil))
+	assert.Equal(t, pp.String(), p.String())
+
+	// comments after the last key
+	p = mustParse(t, "key = value\n\n# tail\n")
+	data, err = p.MarshalBinary()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pp.UnmarshalBinary(data), nil)
+	assert.Equal(t, pp.trailingComments, []string{"tail"})
+	assert.Equal(t, pp.trailingBlank, true)
+	assert.Equal(t, pp.GetComments(""), []string(nil))
+
+	// the first version has no comments after the last key
+	data = append([]byte(binaryHeaderV1), data[len(binaryHeader):len(data)-len("\x01\x01\x04tail")]...)
+	assert.Equal(t, pp.UnmarshalBinary(data), nil)
+	assert.Equal(t, pp.Keys(), []string{"key"})
+	assert.Equal(t, pp.trailingComments, []string(nil))
+
+	// empty properties
+	data, err = NewProperties().MarshalBinary()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pp.UnmarshalBinary(data), nil)
+	assert.Equal(t, pp.Len(), 0)
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	p := mustParse(t, "a = ${b}\nb = 1")
+	data, err := p.MarshalBinary()
+	assert.Equal(t, err, nil)
+
+	pp := mustParse(t, "x = y")
+	for i := 0; i < len(data); i++ {
+		assert.Equal(t, pp.UnmarshalBinary(data[:i]), errInvalidBinary)
+	}
+	assert.Equal(t, pp.UnmarshalBinary(append(data, 0)), errInvalidBinary)
+	assert.Equal(t, pp.UnmarshalBinary([]byte("x = y")), errInvalidBinary)
+	assert.Equal(t, pp.Map(), map[string]string{"x": "y"})
+
+	// circular references are rejected unless expansion is disabled
+	p.DisableExpansion = true
+	p.MustSet("b", "${a}")
+	data, err = p.MarshalBinary()
+	assert.Equal(t, err, nil)
+	assert.Matches(t, pp.UnmarshalBinary(data).Error(), "circular reference")
+	assert.Equal(t, pp.Map(), map[string]string{"x": "y"})
+	pp.DisableExpansion = true
+	assert.Equal(t, pp.UnmarshalBinary(data), nil)
+	assert.Equal(t, pp.Map(), map[string]string{"a": "${b}", "b": "${a}"})
+}
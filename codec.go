@@ -0,0 +1,183 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marshal returns the properties for the exported fields of a struct.
+// It is the inverse of Decode and uses the same keys, prefixes and tag
+// options.
+//
+// String, boolean and numeric fields are stored with their value.
+// time.Duration fields are stored in the form of Duration.String() and
+// time.Time fields with the layout from the field's tag or time.RFC3339.
+//
+// Arrays and slices are stored as a semicolon separated list of values.
+// Since Decode splits the list at semicolons and omits empty elements an
+// error is returned for elements which are empty, contain a semicolon or
+// have leading or trailing whitespace.
+//
+// Struct and map fields are stored recursively with the field's key plus
+// "." as prefix. Map keys must be strings and are stored in sorted order.
+// Embedded structs are stored without a prefix unless a key is set in the
+// field's tag. Nil pointers are skipped.
+//
+// Fields with a zero value are stored unless the field's tag contains the
+// 'omitempty' option.
+//
+// Examples:
+//
+//	// Field is stored as 'Field'.
+//	Field int
+//
+//	// Field is stored as 'myName' and skipped if it is 0.
+//	Field int `properties:"myName,omitempty"`
+func Marshal(x interface{}) (*Properties, error) {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("not a struct or pointer to struct: %s", reflect.TypeOf(x))
+	}
+
+	p := NewProperties()
+	p.DisableExpansion = true
+	if err := enc(p, "", nil, v); err != nil {
+		return nil, err
+	}
+	p.DisableExpansion = false
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func enc(p *Properties, key string, opts map[string]string, v reflect.Value) error {
+	t := v.Type()
+
+	// str converts a value to its string form.
+	str := func(v reflect.Value) (string, error) {
+		t := v.Type()
+		switch {
+		case isDuration(t):
+			return time.Duration(v.Int()).String(), nil
+
+		case isTime(t):
+			layout := opts["layout"]
+			if layout == "" {
+				layout = time.RFC3339
+			}
+			return v.Interface().(time.Time).Format(layout), nil
+
+		case isBool(t):
+			return strconv.FormatBool(v.Bool()), nil
+
+		case isString(t):
+			return v.String(), nil
+
+		case isFloat(t):
+			return strconv.FormatFloat(v.Float(), 'g', -1, t.Bits()), nil
+
+		case isInt(t):
+			return strconv.FormatInt(v.Int(), 10), nil
+
+		case isUint(t):
+			return strconv.FormatUint(v.Uint(), 10), nil
+
+		default:
+			return "", fmt.Errorf("unsupported type %s", t)
+		}
+	}
+
+	if _, ok := opts["omitempty"]; ok && v.IsZero() {
+		return nil
+	}
+
+	switch {
+	case isDuration(t) || isTime(t) || isBool(t) || isString(t) || isFloat(t) || isInt(t) || isUint(t):
+		s, err := str(v)
+		if err != nil {
+			return err
+		}
+		_, _, err = p.Set(key, s)
+		return err
+
+	case isPtr(t):
+		if v.IsNil() {
+			return nil
+		}
+		return enc(p, key, opts, v.Elem())
+
+	case isStruct(t):
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			fk, fopts := parseTag(f.Tag.Get("properties"))
+			if fk == "-" {
+				continue
+			}
+			if isEmbedded(f) {
+				if err := enc(p, key, nil, v.Field(i)); err != nil {
+					return err
+				}
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if fk == "" {
+				fk = f.Name
+			}
+			if key != "" {
+				fk = key + "." + fk
+			}
+			if err := enc(p, fk, fopts, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case isArray(t):
+		vals := make([]string, v.Len())
+		for i := range vals {
+			s, err := str(v.Index(i))
+			if err != nil {
+				return err
+			}
+			if s == "" || strings.Contains(s, ";") || strings.TrimSpace(s) != s {
+				return fmt.Errorf("cannot encode element %q of key %s", s, key)
+			}
+			vals[i] = s
+		}
+		_, _, err := p.Set(key, strings.Join(vals, ";"))
+		return err
+
+	case isMap(t):
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", t)
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, mk := range keys {
+			if err := enc(p, key+"."+mk.String(), nil, v.MapIndex(mk)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported type %s", t)
+	}
+}
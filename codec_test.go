@@ -0,0 +1,98 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestMarshal(t *testing.T) {
+	type DB struct {
+		Host string `properties:"host"`
+		Port int    `properties:"port"`
+	}
+	type Common struct {
+		Debug bool `properties:"debug"`
+	}
+	type S struct {
+		Common
+		S     string
+		I     int
+		U8    uint8
+		F     float64
+		D     time.Duration
+		TM    time.Time `properties:"tm,layout=2006-01-02"`
+		L     []string  `properties:"list"`
+		DB    DB        `properties:"db"`
+		M     map[string]int
+		Empty string `properties:"empty,omitempty,default="`
+		Zero  int    `properties:"zero"`
+		Skip  string `properties:"-"`
+	}
+	in := &S{
+		Common: Common{Debug: true},
+		S:      "abc",
+		I:      -1,
+		U8:     8,
+		F:      3.25,
+		D:      90 * time.Second,
+		TM:     tm(t, "2006-01-02", "2015-01-02"),
+		L:      []string{"a", "b"},
+		DB:     DB{Host: "h", Port: 5432},
+		M:      map[string]int{"b": 2, "a": 1},
+		Skip:   "skip",
+	}
+	p, err := Marshal(in)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.String(), `debug = true
+S = abc
+I = -1
+U8 = 8
+F = 3.25
+D = 1m30s
+tm = 2015-01-02
+list = a;b
+db.host = h
+db.port = 5432
+M.a = 1
+M.b = 2
+zero = 0
+`)
+
+	// the properties decode into the same struct
+	out := &S{}
+	assert.Equal(t, p.Decode(out), nil)
+	in.Skip = ""
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("\ngot  %+v\nwant %+v", out, in)
+	}
+
+	// unexported fields and nil pointers are skipped
+	p, err = Marshal(struct{ a, B int }{1, 2})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.String(), "B = 2\n")
+	p, err = Marshal(&struct{ DB *DB }{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Len(), 0)
+	p, err = Marshal(&struct{ DB *DB }{&DB{"h", 1}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.String(), "DB.host = h\nDB.port = 1\n")
+
+	_, err = Marshal("x")
+	assert.Equal(t, err.Error(), "not a struct or pointer to struct: string")
+	_, err = Marshal(struct{ C chan int }{})
+	assert.Equal(t, err.Error(), "unsupported type chan int")
+
+	// elements which cannot be decoded again are rejected
+	for _, l := range []string{"a;b", "", " a"} {
+		_, err = Marshal(struct{ L []string }{[]string{l, "c"}})
+		assert.Equal(t, err.Error(), fmt.Sprintf("cannot encode element %q of key L", l))
+	}
+}
@@ -5,7 +5,9 @@
 package properties
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
@@ -16,6 +18,7 @@ import (
 //
 // Decode traverses v recursively and returns an error if a value cannot be
 // converted to the field type or a required value is missing for a field.
+// Conversion errors name the key and the field.
 //
 // The following type dependent decodings are used:
 //
@@ -25,6 +28,10 @@ import (
 // required. If the value cannot be converted to the field type an error is
 // returned.
 //
+// A field can fall back to an environment variable by setting the 'env'
+// option in the field's tag. The property value takes precedence over the
+// environment variable which takes precedence over the default value.
+//
 // time.Duration fields have the result of time.ParseDuration() assigned.
 //
 // time.Time fields have the vaule of time.Parse() assigned. The default layout
@@ -41,6 +48,9 @@ import (
 // Default values are not supported in the field's tag. Specify them on the
 // fields of the inner struct instead.
 //
+// Embedded struct fields are decoded recursively without a prefix as if
+// their fields were promoted unless a key is set in the field's tag.
+//
 // Map fields must have a key of type string and are decoded recursively by
 // using the field's name plus ".' as prefix and the next element of the key
 // name as map key. The prefix (without dot) can be overridden in the field's
@@ -65,6 +75,11 @@ import (
 //	// value 15 if the key does not exist.
 //	Field int `properties:",default=15"`
 //
+//	// Field is assigned value of key 'db.host', the value of
+//	// the environment variable DB_HOST if the key does not exist
+//	// or the default value "localhost" otherwise.
+//	Field string `properties:"db.host,env=DB_HOST,default=localhost"`
+//
 //	// Field is assigned value of key 'date' and the date
 //	// is in format 2006-01-02
 //	Field time.Time `properties:"date,layout=2006-01-02"`
@@ -105,11 +120,17 @@ func (p *Properties) Decode(x interface{}) error {
 func dec(p *Properties, key string, def *string, opts map[string]string, v reflect.Value) error {
 	t := v.Type()
 
-	// value returns the property value for key or the default if provided.
+	// value returns the property value for key, the value of the
+	// environment variable from the tag or the default if provided.
 	value := func() (string, error) {
 		if val, ok := p.Get(key); ok {
 			return val, nil
 		}
+		if env := opts["env"]; env != "" {
+			if val, ok := os.LookupEnv(env); ok {
+				return val, nil
+			}
+		}
 		if def != nil {
 			return *def, nil
 		}
@@ -178,7 +199,7 @@ func dec(p *Properties, key string, def *string, opts map[string]string, v refle
 		}
 		val, err := conv(s, t)
 		if err != nil {
-			return err
+			return &convError{key: key, value: s, typ: t, err: err}
 		}
 		v.Set(val)
 
@@ -192,6 +213,21 @@ func dec(p *Properties, key string, def *string, opts map[string]string, v refle
 			if fk == "-" {
 				continue
 			}
+			if isEmbedded(t.Field(i)) {
+				if isPtr(fv.Type()) {
+					if !fv.CanSet() {
+						return fmt.Errorf("cannot set %s", t.Field(i).Name)
+					}
+					if fv.IsNil() {
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				if err := dec(p, key, nil, nil, fv); err != nil {
+					return err
+				}
+				continue
+			}
 			if !fv.CanSet() {
 				return fmt.Errorf("cannot set %s", t.Field(i).Name)
 			}
@@ -199,6 +235,10 @@ func dec(p *Properties, key string, def *string, opts map[string]string, v refle
 				fk = key + "." + fk
 			}
 			if err := dec(p, fk, def, opts, fv); err != nil {
+				var ce *convError
+				if errors.As(err, &ce) && ce.field == "" {
+					ce.field = t.Name() + "." + t.Field(i).Name
+				}
 				return err
 			}
 		}
@@ -214,7 +254,7 @@ func dec(p *Properties, key string, def *string, opts map[string]string, v refle
 		for _, s := range vals {
 			val, err := conv(s, t.Elem())
 			if err != nil {
-				return err
+				return &convError{key: key, value: s, typ: t.Elem(), err: err}
 			}
 			a = reflect.Append(a, val)
 		}
@@ -239,6 +279,22 @@ func dec(p *Properties, key string, def *string, opts map[string]string, v refle
 	return nil
 }
 
+// convError describes a value which cannot be converted to the type of
+// the struct field it is decoded into.
+type convError struct {
+	key   string
+	value string
+	field string
+	typ   reflect.Type
+	err   error
+}
+
+func (e *convError) Error() string {
+	return fmt.Sprintf("cannot decode value %q of key %s into field %s of type %s: %s", e.value, e.key, e.field, e.typ, e.err)
+}
+
+func (e *convError) Unwrap() error { return e.err }
+
 // split splits a string on sep, trims whitespace of elements
 // and omits empty elements
 func split(s string, sep string) []string {
@@ -270,6 +326,22 @@ func parseTag(tag string) (key string, opts map[string]string) {
 	return key, opts
 }
 
+// isEmbedded reports whether the field is an embedded struct without
+// a key in the tag whose fields are decoded as if they were promoted.
+func isEmbedded(f reflect.StructField) bool {
+	if !f.Anonymous {
+		return false
+	}
+	if key, _ := parseTag(f.Tag.Get("properties")); key != "" {
+		return false
+	}
+	t := f.Type
+	if isPtr(t) {
+		t = t.Elem()
+	}
+	return isStruct(t) && !isTime(t)
+}
+
 func isArray(t reflect.Type) bool    { return t.Kind() == reflect.Array || t.Kind() == reflect.Slice }
 func isBool(t reflect.Type) bool     { return t.Kind() == reflect.Bool }
 func isDuration(t reflect.Type) bool { return t == reflect.TypeOf(time.Second) }
@@ -5,7 +5,9 @@
 package properties
 
 import (
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -113,6 +115,20 @@ func TestDecodeValueDefaults(t *testing.T) {
 	testDecode(t, "", &S{}, out)
 }
 
+func TestDecodeValueEnv(t *testing.T) {
+	type S struct {
+		Host string `properties:"db.host,env=_DECODE_DB_HOST,default=localhost"`
+	}
+	os.Unsetenv("_DECODE_DB_HOST")
+	testDecode(t, "db.host=h", &S{}, &S{Host: "h"})
+	testDecode(t, "", &S{}, &S{Host: "localhost"})
+
+	os.Setenv("_DECODE_DB_HOST", "envhost")
+	defer os.Unsetenv("_DECODE_DB_HOST")
+	testDecode(t, "db.host=h", &S{}, &S{Host: "h"})
+	testDecode(t, "", &S{}, &S{Host: "envhost"})
+}
+
 func TestDecodeArrays(t *testing.T) {
 	type S struct {
 		S   []string
@@ -245,6 +261,45 @@ func TestDecodeStruct(t *testing.T) {
 	testDecode(t, in, &S{}, out)
 }
 
+func TestDecodeEmbedded(t *testing.T) {
+	type Common struct {
+		Host string `properties:"host"`
+		Port int    `properties:"port,default=80"`
+	}
+	type common struct {
+		Debug bool `properties:"debug"`
+	}
+	type Extra struct {
+		Name string `properties:"name"`
+	}
+	type Config struct {
+		Common
+		common
+		*Extra
+		DB Common `properties:"db"`
+	}
+	in := `
+	host=h
+	debug=true
+	name=n
+	db.host=dbh
+	db.port=5432
+	`
+	out := &Config{
+		Common: Common{Host: "h", Port: 80},
+		common: common{Debug: true},
+		Extra:  &Extra{Name: "n"},
+		DB:     Common{Host: "dbh", Port: 5432},
+	}
+	testDecode(t, in, &Config{}, out)
+
+	// a key in the tag disables promotion
+	type Prefixed struct {
+		Common `properties:"c"`
+	}
+	testDecode(t, "c.host=h", &Prefixed{}, &Prefixed{Common{Host: "h", Port: 80}})
+}
+
 func TestDecodeMap(t *testing.T) {
 	type S struct {
 		A string `properties:"a"`
@@ -298,3 +353,33 @@ func tm(t *testing.T, layout, s string) time.Time {
 	}
 	return tm
 }
+
+func TestDecodeConversionError(t *testing.T) {
+	type DB struct {
+		Port int `properties:"port"`
+	}
+	type Config struct {
+		Timeout time.Duration
+		Ports   []uint `properties:"ports"`
+		DB      DB     `properties:"db"`
+		Limits  map[string]int
+	}
+	tests := []struct {
+		in, err string
+	}{
+		{"Timeout=x\nports=1\ndb.port=1", `cannot decode value "x" of key Timeout into field Config.Timeout of type time.Duration: time: invalid duration`},
+		{"Timeout=1s\nports=1;-2\ndb.port=1", `cannot decode value "-2" of key ports into field Config.Ports of type uint: strconv.ParseUint: parsing "-2": invalid syntax`},
+		{"Timeout=1s\nports=1\ndb.port=abc", `cannot decode value "abc" of key db.port into field DB.Port of type int: strconv.ParseInt: parsing "abc": invalid syntax`},
+		{"Timeout=1s\nports=1\ndb.port=1\nLimits.a=x", `cannot decode value "x" of key Limits.a into field Config.Limits of type int: strconv.ParseInt: parsing "x": invalid syntax`},
+	}
+	for _, test := range tests {
+		p := mustParse(t, test.in)
+		err := p.Decode(&Config{})
+		if err == nil {
+			t.Fatalf("%q: got nil want error", test.in)
+		}
+		if got, want := err.Error(), test.err; !strings.HasPrefix(got, want) {
+			t.Fatalf("got %q want prefix %q", got, want)
+		}
+	}
+}
@@ -29,7 +29,8 @@
 //
 // All of the different key/value delimiters ' ', ':' and '=' are
 // supported as well as the comment characters '!' and '#' and
-// multi-line values.
+// multi-line keys and values. Like in Java a line ending with a
+// backslash continues on the next line for keys as well as values.
 //
 //	! this is a comment
 //	# and so is this
@@ -77,6 +78,10 @@
 //	USER = foo
 //	u = ${USER}
 //
+//	# fallback value if neither key nor env var exist: port = 8080
+//	port = ${PORT:-${default.port}}
+//	default.port = 8080
+//
 // The default property expansion format is ${key} but can be
 // changed by setting different pre- and postfix values on the
 // Properties object.
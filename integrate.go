@@ -14,6 +14,7 @@ import "flag"
 //	flag.Parse()
 //	p.MustFlag(flag.CommandLine)
 func (p *Properties) MustFlag(dst *flag.FlagSet) {
+	p.mustResolve()
 	m := make(map[string]*flag.Flag)
 	dst.VisitAll(func(f *flag.Flag) {
 		m[f.Name] = f
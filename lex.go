@@ -24,6 +24,7 @@ type item struct {
 	typ itemType // The type of this item.
 	pos int      // The starting position, in bytes, of this item in the input string.
 	val string   // The value of this item.
+	raw string   // The original text of a value item.
 }
 
 func (i item) String() string {
@@ -47,6 +48,7 @@ const (
 	itemKey     // a key
 	itemValue   // a value
 	itemComment // a comment
+	itemSection // a section header
 )
 
 // defines a constant for EOF
@@ -55,6 +57,39 @@ const eof = -1
 // permitted whitespace characters space, FF and TAB
 const whitespace = " \f\t"
 
+// lexOptions configures the scanner.
+type lexOptions struct {
+	// delimiter is an additional key/value delimiter which
+	// can consist of more than one character, e.g. "=>".
+	delimiter string
+
+	// preserveFormatting records formatting details like the
+	// comment characters for writing the properties back.
+	preserveFormatting bool
+
+	// normalizeNewlines converts CRLF and CR in values to LF.
+	normalizeNewlines bool
+
+	// requireDelimiter rejects keys which are separated from
+	// their value only by whitespace.
+	requireDelimiter bool
+
+	// respectQuotes takes values which start with a double
+	// quote verbatim up to the closing double quote.
+	respectQuotes bool
+
+	// sections scans lines of the form '[name]' as section headers.
+	sections bool
+
+	// keepKeyWhitespace scans keys up to the delimiter including
+	// unescaped whitespace.
+	keepKeyWhitespace bool
+
+	// strictComments scans comment characters as the start of a
+	// comment only in the first column of a line.
+	strictComments bool
+}
+
 // stateFn represents the state of the scanner as a function that returns the next state.
 type stateFn func(*lexer) stateFn
 
@@ -68,6 +103,7 @@ type lexer struct {
 	lastPos int       // position of most recent item returned by nextItem
 	runes   []rune    // scanned runes for this item
 	items   chan item // channel of scanned items
+	opts    lexOptions
 }
 
 // next returns the next rune in the input.
@@ -96,7 +132,7 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	i := item{t, l.start, string(l.runes)}
+	i := item{t, l.start, string(l.runes), ""}
 	l.items <- i
 	l.start = l.pos
 	l.runes = l.runes[:0]
@@ -138,7 +174,7 @@ func (l *lexer) lineNumber() int {
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
+	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...), ""}
 	return nil
 }
 
@@ -150,11 +186,12 @@ func (l *lexer) nextItem() item {
 }
 
 // lex creates a new scanner for the input string.
-func lex(input string) *lexer {
+func lex(input string, opts lexOptions) *lexer {
 	l := &lexer{
 		input: input,
 		items: make(chan item),
 		runes: make([]rune, 0, 32),
+		opts:  opts,
 	}
 	go l.run()
 	return l
@@ -180,9 +217,13 @@ func lexBeforeKey(l *lexer) stateFn {
 		l.ignore()
 		return lexBeforeKey
 
-	case isComment(r):
+	case isComment(r) && (!l.opts.strictComments || l.atLineStart()):
 		return lexComment
 
+	case r == '[' && l.opts.sections:
+		l.ignore()
+		return lexSection
+
 	case isWhitespace(r):
 		l.ignore()
 		return lexBeforeKey
@@ -193,17 +234,28 @@ func lexBeforeKey(l *lexer) stateFn {
 	}
 }
 
+// atLineStart reports whether the last scanned rune is in the first
+// column of a line.
+func (l *lexer) atLineStart() bool {
+	i := l.pos - l.width
+	return i == 0 || isEOL(rune(l.input[i-1]))
+}
+
 // lexComment scans a comment line. The comment character has already been scanned.
 func lexComment(l *lexer) stateFn {
+	// the comment item starts at the comment character
+	start := l.start
 	l.acceptRun(whitespace)
 	l.ignore()
 	for {
 		switch r := l.next(); {
 		case isEOF(r):
-			l.ignore()
+			l.start = start
+			l.emit(itemComment)
 			l.emit(itemEOF)
 			return nil
 		case isEOL(r):
+			l.start = start
 			l.emit(itemComment)
 			return lexBeforeKey
 		default:
@@ -212,20 +264,59 @@ func lexComment(l *lexer) stateFn {
 	}
 }
 
+// lexSection scans a section header until the closing bracket which must
+// be followed only by whitespace until the end of the line. The opening
+// bracket has already been scanned.
+func lexSection(l *lexer) stateFn {
+	for {
+		switch r := l.next(); {
+		case r == ']':
+			l.acceptRun(whitespace)
+			if r := l.peek(); !isEOL(r) && !isEOF(r) {
+				return l.errorf("unexpected text after section")
+			}
+			l.runes = []rune(strings.Trim(string(l.runes), whitespace))
+			l.emit(itemSection)
+			return lexBeforeKey
+
+		case isEOL(r), isEOF(r):
+			return l.errorf("unterminated section")
+
+		default:
+			l.appendRune(r)
+		}
+	}
+}
+
 // lexKey scans the key up to a delimiter
 func lexKey(l *lexer) stateFn {
 	var r rune
 
 Loop:
 	for {
+		if l.atDelimiter() {
+			break Loop
+		}
+
 		switch r = l.next(); {
 
 		case isEscape(r):
+			// keys can be continued on the next line like values
+			if isEOL(l.peek()) {
+				if l.next() == '\r' {
+					l.accept("\n")
+				}
+				l.acceptRun(whitespace)
+				continue
+			}
 			err := l.scanEscapeSequence()
 			if err != nil {
 				return l.errorf(err.Error())
 			}
 
+		case isWhitespace(r) && l.opts.keepKeyWhitespace:
+			l.appendRune(r)
+
 		case isEndOfKey(r):
 			l.backup()
 			break Loop
@@ -255,9 +346,19 @@ Loop:
 // We expect to be just after the key.
 func lexBeforeValue(l *lexer) stateFn {
 	l.acceptRun(whitespace)
-	l.accept(":=")
+	if l.atDelimiter() {
+		l.pos += len(l.opts.delimiter)
+	} else if !l.accept(":=") && l.opts.requireDelimiter {
+		if r := l.peek(); !isEOL(r) && !isEOF(r) {
+			return l.errorf("missing delimiter after key")
+		}
+	}
 	l.acceptRun(whitespace)
 	l.ignore()
+	if l.opts.respectQuotes && l.accept(`"`) {
+		l.ignore()
+		return lexQuotedValue
+	}
 	return lexValue
 }
 
@@ -267,7 +368,10 @@ func lexValue(l *lexer) stateFn {
 		switch r := l.next(); {
 		case isEscape(r):
 			if isEOL(l.peek()) {
-				l.next()
+				// treat CRLF as a single line break
+				if l.next() == '\r' {
+					l.accept("\n")
+				}
 				l.acceptRun(whitespace)
 			} else {
 				err := l.scanEscapeSequence()
@@ -277,12 +381,12 @@ func lexValue(l *lexer) stateFn {
 			}
 
 		case isEOL(r):
-			l.emit(itemValue)
+			l.emitValue(l.input[l.start : l.pos-l.width])
 			l.ignore()
 			return lexBeforeKey
 
 		case isEOF(r):
-			l.emit(itemValue)
+			l.emitValue(l.input[l.start:l.pos])
 			l.emit(itemEOF)
 			return nil
 
@@ -292,6 +396,66 @@ func lexValue(l *lexer) stateFn {
 	}
 }
 
+// lexQuotedValue scans text until the closing double quote which must be
+// followed only by whitespace until the end of the line. We expect to be
+// just after the opening double quote.
+func lexQuotedValue(l *lexer) stateFn {
+	for {
+		switch r := l.next(); {
+		case isEscape(r):
+			if isEOL(l.peek()) {
+				// treat CRLF as a single line break
+				if l.next() == '\r' {
+					l.accept("\n")
+				}
+				l.acceptRun(whitespace)
+			} else {
+				err := l.scanEscapeSequence()
+				if err != nil {
+					return l.errorf(err.Error())
+				}
+			}
+
+		case r == '"':
+			// the original text includes the quotes
+			raw := l.input[l.start-1 : l.pos]
+			l.acceptRun(whitespace)
+			if r := l.peek(); !isEOL(r) && !isEOF(r) {
+				return l.errorf("unexpected text after quoted value")
+			}
+			l.emitValue(raw)
+			return lexBeforeKey
+
+		case isEOL(r), isEOF(r):
+			return l.errorf("unterminated quoted value")
+
+		default:
+			l.appendRune(r)
+		}
+	}
+}
+
+// emitValue emits the current value with its original text raw
+// and converts CRLF and CR to LF if configured.
+func (l *lexer) emitValue(raw string) {
+	if l.opts.normalizeNewlines {
+		runes := l.runes[:0]
+		for i, r := range l.runes {
+			switch {
+			case r == '\r' && i+1 < len(l.runes) && l.runes[i+1] == '\n':
+				continue
+			case r == '\r':
+				r = '\n'
+			}
+			runes = append(runes, r)
+		}
+		l.runes = runes
+	}
+	l.items <- item{itemValue, l.start, string(l.runes), raw}
+	l.start = l.pos
+	l.runes = l.runes[:0]
+}
+
 // scanEscapeSequence scans either one of the escaped characters
 // or a unicode literal. We expect to be after the escape character.
 func (l *lexer) scanEscapeSequence() error {
@@ -335,6 +499,26 @@ func (l *lexer) scanUnicodeLiteral() error {
 	return nil
 }
 
+// checkUnicodeLiterals returns an error if s contains a '\u' which is
+// followed by one to three hex digits, e.g. '\u12'. A '\u' without hex
+// digits like in 'C:\users' is not a unicode literal.
+func checkUnicodeLiterals(s string) error {
+	for {
+		i := strings.Index(s, "\\u")
+		if i == -1 {
+			return nil
+		}
+		s = s[i+2:]
+		n := 0
+		for n < 4 && n < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[n]) != -1 {
+			n++
+		}
+		if n > 0 && n < 4 {
+			return fmt.Errorf("invalid unicode literal")
+		}
+	}
+}
+
 // decodeEscapedCharacter returns the unescaped rune. We expect to be after the escape character.
 func decodeEscapedCharacter(r rune) rune {
 	switch r {
@@ -357,6 +541,12 @@ func atUnicodeLiteral(r rune) bool {
 	return r == 'u'
 }
 
+// atDelimiter reports whether the input at the current position starts
+// with the configured multi-character delimiter.
+func (l *lexer) atDelimiter() bool {
+	return l.opts.delimiter != "" && strings.HasPrefix(l.input[l.pos:], l.opts.delimiter)
+}
+
 // isComment reports whether we are at the start of a comment.
 func isComment(r rune) bool {
 	return r == '#' || r == '!'
@@ -7,8 +7,11 @@ package properties
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -45,6 +48,99 @@ type Loader struct {
 	// 404 are reported as errors. When set to true, missing files and 404
 	// status codes are not reported as errors.
 	IgnoreMissing bool
+
+	// Delimiter configures an additional key/value delimiter which can
+	// consist of more than one character, e.g. "=>". The standard
+	// delimiters ' ', ':' and '=' are still recognized. The delimiter is
+	// stored in Properties.Delimiter of the returned property object.
+	Delimiter string
+
+	// IgnoreCase configures whether the keys of the returned property
+	// object are matched case-insensitively. See Properties.IgnoreCase.
+	IgnoreCase bool
+
+	// PreserveFormatting configures whether formatting details of the
+	// input like the comment characters are recorded so that Write can
+	// reproduce them. See Properties.PreserveFormatting.
+	PreserveFormatting bool
+
+	// MaxRedirects configures the maximum number of redirects LoadURL
+	// follows. A value of zero uses the default of 10 redirects and a
+	// negative value disables redirects.
+	MaxRedirects int
+
+	// AllowInsecureRedirect configures whether LoadURL follows redirects
+	// to a different host or from https to http. By default these
+	// redirects are reported as error.
+	AllowInsecureRedirect bool
+
+	// NormalizeNewlines configures whether CRLF and CR characters in
+	// values, e.g. from escaped '\r\n' sequences, are converted to LF.
+	// The line endings of the input are not affected.
+	NormalizeNewlines bool
+
+	// RequireExplicitDelimiter configures whether keys must be separated
+	// from their values by '=' or ':' or the custom Delimiter. Keys
+	// which are separated from their value only by whitespace are
+	// reported as error. Keys without a value are permitted.
+	RequireExplicitDelimiter bool
+
+	// ExpandOnLoad configures whether all values are expanded once when
+	// the properties are loaded instead of on every Get. The expanded
+	// values replace the original values which are lost and the
+	// properties are returned with DisableExpansion set to true. Write
+	// therefore writes the expanded values. Circular references and
+	// malformed expressions are reported as error by the loader.
+	ExpandOnLoad bool
+
+	// SelfRefFromEnv configures whether keys which reference themselves
+	// are expanded with the environment variable of the same name instead
+	// of being reported as circular reference. See
+	// Properties.SelfRefFromEnv.
+	SelfRefFromEnv bool
+
+	// RespectQuotes configures whether values which start with a double
+	// quote are taken verbatim up to the closing double quote including
+	// leading and trailing whitespace. An escaped double quote '\"' is
+	// part of the value. The closing double quote must be followed only
+	// by whitespace until the end of the line. A value without a closing
+	// double quote is reported as error. Escape sequences and line
+	// continuations are handled as for unquoted values.
+	RespectQuotes bool
+
+	// MaxBytes limits the number of bytes which LoadFile, LoadURL and
+	// LoadReader read. Larger inputs are reported as error. The default
+	// of 0 means no limit.
+	MaxBytes int64
+
+	// Sections configures whether lines of the form '[name]' are read as
+	// section headers like in INI files. The keys following a section
+	// header are prefixed with the section name and a dot, e.g. 'host'
+	// in the section '[db]' becomes 'db.host'. Repeated sections are
+	// merged. The empty section '[]' ends the current section.
+	Sections bool
+
+	// KeepKeyWhitespace configures whether unescaped whitespace is part
+	// of a key. By default whitespace ends a key and 'my key = value'
+	// defines the key 'my' with the value 'key = value'. With this option
+	// the key extends up to the delimiter or the end of the line including
+	// whitespace before the delimiter, e.g. 'my key ' with the value
+	// 'value'. Whitespace at the beginning of the line is still ignored.
+	// Escaped whitespace like '\ ' is always part of the key.
+	KeepKeyWhitespace bool
+
+	// Validator is called with the key and the unexpanded value of every
+	// loaded entry. If it returns an error loading fails with that error.
+	// The validator is also set on the loaded properties to validate
+	// later changes. See Properties.SetValidator.
+	Validator func(key, value string) error
+
+	// StrictComments configures whether '#' and '!' start a comment only
+	// in the first column of a line. By default they also start a comment
+	// after leading whitespace. With this option an indented line like
+	// '  #key = value' defines the key '#key'. Comment characters in
+	// values and continuation lines never start a comment.
+	StrictComments bool
 }
 
 // Load reads a buffer into a Properties struct.
@@ -52,23 +148,74 @@ func (l *Loader) LoadBytes(buf []byte) (*Properties, error) {
 	return l.loadBytes(buf, l.Encoding)
 }
 
+// LoadDocuments reads a buffer which contains multiple documents separated
+// by lines consisting only of sep into one Properties struct per document.
+// Empty documents result in empty Properties structs.
+func (l *Loader) LoadDocuments(buf []byte, sep string) ([]*Properties, error) {
+	var docs []*Properties
+	for _, doc := range splitDocuments(convert(buf, l.Encoding), sep) {
+		p, err := l.loadBytes([]byte(doc), UTF8)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, p)
+	}
+	return docs, nil
+}
+
+// splitDocuments splits s at all lines which consist only of sep.
+func splitDocuments(s, sep string) []string {
+	var docs []string
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if strings.TrimRight(line, "\r\n") == sep {
+			docs = append(docs, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteString(line)
+	}
+	return append(docs, b.String())
+}
+
 // LoadReader reads an io.Reader into a Properties struct.
 func (l *Loader) LoadReader(r io.Reader) (*Properties, error) {
-	if buf, err := io.ReadAll(r); err != nil {
+	if buf, err := l.readAll(r); err != nil {
 		return nil, err
 	} else {
 		return l.loadBytes(buf, l.Encoding)
 	}
 }
 
+// LoadSection reads length bytes starting at offset from an io.ReaderAt
+// into a Properties struct, e.g. a properties block embedded in a larger
+// file. Only the given section is read.
+func (l *Loader) LoadSection(r io.ReaderAt, offset, length int64) (*Properties, error) {
+	return l.LoadReader(io.NewSectionReader(r, offset, length))
+}
+
 // LoadAll reads the content of multiple URLs or files in the given order into
 // a Properties struct. If IgnoreMissing is true then a 404 status code or
-// missing file will not be reported as error. Encoding sets the encoding for
-// files. For the URLs see LoadURL for the Content-Type header and the
-// encoding.
+// missing file will not be reported as error. Names prefixed with '?' are
+// optional and are ignored if missing regardless of IgnoreMissing. Encoding
+// sets the encoding for files. For the URLs see LoadURL for the Content-Type
+// header and the encoding. The name of the file or URL which provided
+// the value of a key is available via Properties.Source.
 func (l *Loader) LoadAll(names []string) (*Properties, error) {
 	all := NewProperties()
+	all.IgnoreCase = l.IgnoreCase
+	all.PreserveFormatting = l.PreserveFormatting
+	all.Delimiter = l.Delimiter
+	// the values are expanded after all sources have been merged
+	ll := *l
+	ll.ExpandOnLoad = false
 	for _, name := range names {
+		ll.IgnoreMissing = l.IgnoreMissing
+		if strings.HasPrefix(name, "?") {
+			name = name[1:]
+			ll.IgnoreMissing = true
+		}
+
 		n, err := expandName(name)
 		if err != nil {
 			return nil, err
@@ -77,30 +224,124 @@ func (l *Loader) LoadAll(names []string) (*Properties, error) {
 		var p *Properties
 		switch {
 		case strings.HasPrefix(n, "http://"):
-			p, err = l.LoadURL(n)
+			p, err = ll.LoadURL(n)
 		case strings.HasPrefix(n, "https://"):
-			p, err = l.LoadURL(n)
+			p, err = ll.LoadURL(n)
 		default:
-			p, err = l.LoadFile(n)
+			p, err = ll.LoadFile(n)
 		}
 		if err != nil {
 			return nil, err
 		}
+		p.setSource(n)
 		all.Merge(p)
 	}
 
-	all.DisableExpansion = l.DisableExpansion
-	if all.DisableExpansion {
-		return all, nil
+	all, err := l.finish(all)
+	if err != nil {
+		return nil, err
+	}
+	// reload with a copy of the loader and the names
+	rl, rnames := *l, append([]string(nil), names...)
+	all.reload = func() (*Properties, error) { return rl.LoadAll(rnames) }
+	return all, nil
+}
+
+// SourcePlan describes a source which LoadAll would read.
+type SourcePlan struct {
+	// Name is the name of the source as passed to LoadAll.
+	Name string
+
+	// Resolved is the name of the source after the expansion
+	// of environment variables.
+	Resolved string
+
+	// Type is either "file" or "url".
+	Type string
+
+	// Optional is true if the source is ignored when missing.
+	Optional bool
+
+	// Exists is true if the file exists or the URL does not return 404.
+	Exists bool
+}
+
+// Plan returns the sources which LoadAll would read for the given names
+// in order without loading them. Files are checked with os.Stat and URLs
+// with a HEAD request.
+func (l *Loader) Plan(names []string) ([]SourcePlan, error) {
+	var plans []SourcePlan
+	for _, name := range names {
+		sp := SourcePlan{Name: name, Optional: l.IgnoreMissing}
+		if strings.HasPrefix(name, "?") {
+			name = name[1:]
+			sp.Optional = true
+		}
+
+		n, err := expandName(name)
+		if err != nil {
+			return nil, err
+		}
+		sp.Resolved = n
+
+		if strings.HasPrefix(n, "http://") || strings.HasPrefix(n, "https://") {
+			sp.Type = "url"
+			resp, err := l.httpClient().Head(n)
+			if err != nil {
+				return nil, fmt.Errorf("properties: error fetching %q. %s", n, err)
+			}
+			resp.Body.Close()
+			sp.Exists = resp.StatusCode != 404
+		} else {
+			sp.Type = "file"
+			_, err := os.Stat(n)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			sp.Exists = err == nil
+		}
+		plans = append(plans, sp)
+	}
+	return plans, nil
+}
+
+// LoadFSGlob reads all files of the file system fsys which match the pattern
+// in lexical order into a Properties struct. The pattern syntax is the same
+// as for fs.Glob.
+func (l *Loader) LoadFSGlob(fsys fs.FS, pattern string) (*Properties, error) {
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	all := NewProperties()
+	all.IgnoreCase = l.IgnoreCase
+	all.PreserveFormatting = l.PreserveFormatting
+	all.Delimiter = l.Delimiter
+	ll := *l
+	ll.ExpandOnLoad = false
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		p, err := ll.loadBytes(data, l.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		p.setSource(name)
+		all.Merge(p)
 	}
-	return all, all.check()
+
+	return l.finish(all)
 }
 
 // LoadFile reads a file into a Properties struct.
 // If IgnoreMissing is true then a missing file will not be
 // reported as error.
 func (l *Loader) LoadFile(filename string) (*Properties, error) {
-	data, err := os.ReadFile(filename)
+	data, err := l.readFile(filename)
 	if err != nil {
 		if l.IgnoreMissing && os.IsNotExist(err) {
 			LogPrintf("properties: %s not found. skipping", filename)
@@ -108,7 +349,41 @@ func (l *Loader) LoadFile(filename string) (*Properties, error) {
 		}
 		return nil, err
 	}
-	return l.loadBytes(data, l.Encoding)
+	p, err := l.loadBytes(data, l.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	p.setSource(filename)
+	return p, nil
+}
+
+// readFile reads the file and enforces MaxBytes.
+func (l *Loader) readFile(filename string) ([]byte, error) {
+	if l.MaxBytes <= 0 {
+		return os.ReadFile(filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return l.readAll(f)
+}
+
+// readAll reads r until EOF and returns an error if
+// it contains more than MaxBytes bytes.
+func (l *Loader) readAll(r io.Reader) ([]byte, error) {
+	if l.MaxBytes <= 0 {
+		return io.ReadAll(r)
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, l.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > l.MaxBytes {
+		return nil, fmt.Errorf("properties: input exceeds limit of %d bytes", l.MaxBytes)
+	}
+	return buf, nil
 }
 
 // LoadURL reads the content of the URL into a Properties struct.
@@ -120,7 +395,7 @@ func (l *Loader) LoadFile(filename string) (*Properties, error) {
 // encoding is set to UTF-8. A missing content type header is
 // interpreted as 'text/plain; charset=utf-8'.
 func (l *Loader) LoadURL(url string) (*Properties, error) {
-	resp, err := http.Get(url)
+	resp, err := l.httpClient().Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("properties: error fetching %q. %s", url, err)
 	}
@@ -135,7 +410,7 @@ func (l *Loader) LoadURL(url string) (*Properties, error) {
 		return nil, fmt.Errorf("properties: %s returned %d", url, resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := l.readAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("properties: %s error reading response. %s", url, err)
 	}
@@ -155,16 +430,86 @@ func (l *Loader) LoadURL(url string) (*Properties, error) {
 	return l.loadBytes(body, enc)
 }
 
+// httpClient returns an HTTP client which enforces the redirect policy.
+func (l *Loader) httpClient() *http.Client {
+	return &http.Client{CheckRedirect: l.checkRedirect}
+}
+
+// checkRedirect enforces the redirect policy of the loader.
+func (l *Loader) checkRedirect(req *http.Request, via []*http.Request) error {
+	max := l.MaxRedirects
+	if max == 0 {
+		max = 10
+	}
+	if len(via) > max {
+		return fmt.Errorf("stopped after %d redirects", len(via)-1)
+	}
+	if l.AllowInsecureRedirect {
+		return nil
+	}
+	prev := via[len(via)-1].URL
+	if req.URL.Host != prev.Host {
+		return fmt.Errorf("redirect to different host %s not allowed", req.URL.Host)
+	}
+	if prev.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect from https to %s not allowed", req.URL.Scheme)
+	}
+	return nil
+}
+
 func (l *Loader) loadBytes(buf []byte, enc Encoding) (*Properties, error) {
-	p, err := parse(convert(buf, enc))
+	p, err := parseOpts(convert(buf, enc), l.lexOptions())
 	if err != nil {
 		return nil, err
 	}
+	if l.IgnoreCase {
+		p.IgnoreCase = true
+		p.foldKeys()
+	}
+	p.Delimiter = l.Delimiter
+	if l.PreserveFormatting {
+		p.raw, p.rawEnc = append([]byte(nil), buf...), enc
+	}
+	return l.finish(p)
+}
+
+// finish applies the expansion settings and the validator of the loader
+// to the loaded properties and checks them for circular references and
+// malformed expressions.
+func (l *Loader) finish(p *Properties) (*Properties, error) {
 	p.DisableExpansion = l.DisableExpansion
+	p.SelfRefFromEnv = l.SelfRefFromEnv
+	p.SetValidator(l.Validator)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
 	if p.DisableExpansion {
 		return p, nil
 	}
-	return p, p.check()
+	if err := p.check(); err != nil || !l.ExpandOnLoad {
+		return p, err
+	}
+	m := make(map[string]string, len(p.m))
+	for k, v := range p.m {
+		m[k], _ = p.expand(k, v)
+	}
+	p.m = m
+	p.DisableExpansion = true
+	return p, nil
+}
+
+// lexOptions returns the scanner configuration of the loader.
+func (l *Loader) lexOptions() lexOptions {
+	return lexOptions{
+		delimiter:          l.Delimiter,
+		preserveFormatting: l.PreserveFormatting,
+		normalizeNewlines:  l.NormalizeNewlines,
+		requireDelimiter:   l.RequireExplicitDelimiter,
+		respectQuotes:      l.RespectQuotes,
+		sections:           l.Sections,
+		keepKeyWhitespace:  l.KeepKeyWhitespace,
+		strictComments:     l.StrictComments,
+	}
 }
 
 // Load reads a buffer into a Properties struct.
@@ -173,6 +518,13 @@ func Load(buf []byte, enc Encoding) (*Properties, error) {
 	return l.LoadBytes(buf)
 }
 
+// LoadDocuments reads a buffer which contains multiple documents separated
+// by lines consisting only of sep into one Properties struct per document.
+func LoadDocuments(buf []byte, enc Encoding, sep string) ([]*Properties, error) {
+	l := &Loader{Encoding: enc}
+	return l.LoadDocuments(buf, sep)
+}
+
 // LoadString reads an UTF8 string into a properties struct.
 func LoadString(s string) (*Properties, error) {
 	l := &Loader{Encoding: UTF8}
@@ -183,17 +535,58 @@ func LoadString(s string) (*Properties, error) {
 func LoadMap(m map[string]string) *Properties {
 	p := NewProperties()
 	for k, v := range m {
-		p.Set(k, v)
+		p.set(k, v)
 	}
 	return p
 }
 
+// LoadQuery creates a new Properties struct from an URL encoded query
+// string in the form "key1=value1&key2=value2". The keys are stored in
+// the order of the query string.
+func LoadQuery(q string) (*Properties, error) {
+	p := NewProperties()
+	for _, kv := range strings.Split(q, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := p.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
 // LoadFile reads a file into a Properties struct.
 func LoadFile(filename string, enc Encoding) (*Properties, error) {
 	l := &Loader{Encoding: enc}
 	return l.LoadAll([]string{filename})
 }
 
+// LazyLoadFile returns a Properties struct which reads the file on first
+// access instead of immediately. The file is read on the first call of any
+// method which accesses the keys or values with the DisableExpansion and
+// IgnoreCase settings of the returned properties at that time. If the file
+// cannot be read the properties remain empty, the error is returned by Err
+// and the Must functions pass it to the ErrorHandler. The file is read only
+// once even if the properties are accessed by concurrent readers.
+func LazyLoadFile(filename string, enc Encoding) *Properties {
+	p := NewProperties()
+	p.lazy = &lazyLoad{load: func() (*Properties, error) {
+		l := &Loader{Encoding: enc, DisableExpansion: p.DisableExpansion, IgnoreCase: p.IgnoreCase}
+		return l.LoadAll([]string{filename})
+	}}
+	return p
+}
+
 // LoadReader reads an io.Reader into a Properties struct.
 func LoadReader(r io.Reader, enc Encoding) (*Properties, error) {
 	l := &Loader{Encoding: enc}
@@ -279,19 +672,41 @@ func MustLoadAll(names []string, enc Encoding, ignoreMissing bool) *Properties {
 	return must(LoadAll(names, enc, ignoreMissing))
 }
 
+// must returns p if err is nil. Otherwise, it calls the ErrorHandler and
+// returns empty properties if the handler returns.
 func must(p *Properties, err error) *Properties {
 	if err != nil {
 		ErrorHandler(err)
+		return NewProperties()
 	}
 	return p
 }
 
-// expandName expands ${ENV_VAR} expressions in a name.
+// expandName expands ${ENV_VAR} and $ENV_VAR expressions in a name.
 // If the environment variable does not exist then it will be replaced
 // with an empty string. Malformed expressions like "${ENV_VAR" will
 // be reported as error.
 func expandName(name string) (string, error) {
-	return expand(name, []string{}, "${", "}", make(map[string]string))
+	// rewrite $ENV_VAR as ${ENV_VAR}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '$' || i+1 == len(name) || !isNameStart(name[i+1]) {
+			b.WriteByte(name[i])
+			continue
+		}
+		j := i + 1
+		for j < len(name) && (isNameStart(name[j]) || ('0' <= name[j] && name[j] <= '9')) {
+			j++
+		}
+		b.WriteString("${" + name[i+1:j] + "}")
+		i = j - 1
+	}
+	return expand(b.String(), []string{}, "${", "}", make(map[string]string), false, false)
+}
+
+// isNameStart reports whether c can start an environment variable name.
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
 }
 
 // Interprets a byte buffer either as an ISO-8859-1 or UTF-8 encoded string.
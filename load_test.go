@@ -5,12 +5,17 @@
 package properties
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/magiconair/properties/assert"
 )
@@ -52,6 +57,25 @@ func TestLoadString(t *testing.T) {
 	assert.Equal(t, p1, p2)
 }
 
+func TestLoadDocuments(t *testing.T) {
+	input := "key=value\nkey2=${key}\n---\n# second\nkey=other\n---\n"
+	docs, err := LoadDocuments([]byte(input), UTF8, "---")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(docs), 3)
+	assertKeyValues(t, input, docs[0], "key", "value", "key2", "value")
+	assertKeyValues(t, input, docs[1], "key", "other")
+	assert.Equal(t, docs[1].GetComment("key"), "second")
+	assert.Equal(t, docs[2].Len(), 0)
+
+	docs, err = LoadDocuments([]byte("key=value\r\n---\r\nkey=äöü"), UTF8, "---")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(docs), 2)
+	assertKeyValues(t, input, docs[1], "key", "äöü")
+
+	_, err = LoadDocuments([]byte("key=value\n---\nkey=${key"), UTF8, "---")
+	assert.Matches(t, err.Error(), "malformed expression")
+}
+
 func TestLoadMap(t *testing.T) {
 	// LoadMap does not guarantee the same import order
 	// of keys every time since map access is randomized.
@@ -60,6 +84,24 @@ func TestLoadMap(t *testing.T) {
 	assert.Equal(t, LoadMap(m).Map(), m)
 }
 
+func TestLoadQuery(t *testing.T) {
+	p := NewProperties()
+	p.MustSet("key", "value")
+	p.MustSet("a b", "c d&e=f")
+	p.MustSet("x", "ä+%/?")
+	p.MustSet("y", "${key}")
+	q := p.ToQuery()
+	assert.Equal(t, q, "key=value&a+b=c+d%26e%3Df&x=%C3%A4%2B%25%2F%3F&y=value")
+
+	pp, err := LoadQuery(q)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pp.Keys(), []string{"key", "a b", "x", "y"})
+	assertKeyValues(t, q, pp, "key", "value", "a b", "c d&e=f", "x", "ä+%/?", "y", "value")
+
+	_, err = LoadQuery("a=%zz")
+	assert.Matches(t, err.Error(), "invalid URL escape")
+}
+
 func TestLoadFile(t *testing.T) {
 	tf := make(tempFiles, 0)
 	defer tf.removeAll()
@@ -94,6 +136,33 @@ func TestLoadExpandedFile(t *testing.T) {
 	assertKeyValues(t, "", p, "key", "value")
 }
 
+func TestExpandName(t *testing.T) {
+	if err := os.Setenv("_VARX", "some-value"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, want, err string
+	}{
+		{"$_VARX/x", "some-value/x", ""},
+		{"${_VARX}/x", "some-value/x", ""},
+		{"a$_VARX.b", "asome-value.b", ""},
+		{"$_VARX$_VARX", "some-valuesome-value", ""},
+		{"/x/$_VARX_NONE/y", "/x//y", ""},
+		{"$/x$", "$/x$", ""},
+		{"$1", "$1", ""},
+		{"${_VARX/x", "", "malformed expression"},
+	}
+	for _, test := range tests {
+		got, err := expandName(test.name)
+		if test.err != "" {
+			assert.Matches(t, err.Error(), test.err)
+			continue
+		}
+		assert.Equal(t, err, nil)
+		assert.Equal(t, got, test.want, test.name)
+	}
+}
+
 func TestLoadFilesAndIgnoreMissing(t *testing.T) {
 	tf := make(tempFiles, 0)
 	defer tf.removeAll()
@@ -144,6 +213,47 @@ func TestLoadURLEncoding(t *testing.T) {
 	}
 }
 
+func TestLoadURLRedirects(t *testing.T) {
+	srv := testServer()
+	defer srv.Close()
+
+	var redir *httptest.Server
+	redir = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.RequestURI {
+		case "/local":
+			http.Redirect(w, r, "/remote", http.StatusFound)
+		case "/remote":
+			http.Redirect(w, r, srv.URL+"/a", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, redir.URL+"/loop", http.StatusFound)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer redir.Close()
+
+	l := &Loader{Encoding: UTF8}
+	_, err := l.LoadURL(redir.URL + "/local")
+	assert.Matches(t, err.Error(), "redirect to different host .* not allowed")
+
+	l.AllowInsecureRedirect = true
+	p, err := l.LoadURL(redir.URL + "/local")
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value")
+
+	l.MaxRedirects = 1
+	_, err = l.LoadURL(redir.URL + "/local")
+	assert.Matches(t, err.Error(), "stopped after 1 redirects")
+
+	l.MaxRedirects = -1
+	_, err = l.LoadURL(redir.URL + "/remote")
+	assert.Matches(t, err.Error(), "stopped after 0 redirects")
+
+	l.MaxRedirects = 0
+	_, err = l.LoadURL(redir.URL + "/loop")
+	assert.Matches(t, err.Error(), "stopped after 10 redirects")
+}
+
 func TestLoadURLFailInvalidEncoding(t *testing.T) {
 	srv := testServer()
 	defer srv.Close()
@@ -166,6 +276,59 @@ func TestLoadAll(t *testing.T) {
 	assertKeyValues(t, "", p, "key", "value4", "key2", "value2")
 }
 
+func TestLoadAllSource(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	filename := tf.makeFile("key=value\nkey2=value2")
+	filename2 := tf.makeFile("key=value3")
+	srv := testServer()
+	defer srv.Close()
+
+	l := &Loader{Encoding: UTF8}
+	p, err := l.LoadAll([]string{filename, srv.URL + "/a", filename2})
+	assert.Equal(t, err, nil)
+	for key, want := range map[string]string{"key": filename2, "key2": filename} {
+		src, ok := p.Source(key)
+		assert.Equal(t, ok, true)
+		assert.Equal(t, src, want, key)
+	}
+
+	// keys set in code have no source
+	p.MustSet("key", "x")
+	p.MustSet("key3", "y")
+	for _, key := range []string{"key", "key3", "missing"} {
+		_, ok := p.Source(key)
+		assert.Equal(t, ok, false, key)
+	}
+
+	// the source is preserved when merging
+	pp := NewProperties()
+	pp.Merge(p)
+	src, _ := pp.Source("key2")
+	assert.Equal(t, src, filename)
+	p.Delete("key2")
+	_, ok := p.Source("key2")
+	assert.Equal(t, ok, false)
+}
+
+func TestLoadAllOptional(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	filename := tf.makeFile("key=value")
+	srv := testServer()
+	defer srv.Close()
+
+	l := &Loader{Encoding: UTF8}
+	p, err := l.LoadAll([]string{filename, "?" + filename + "foo", "?" + srv.URL + "/c", srv.URL + "/b"})
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value", "key2", "value2")
+
+	_, err = l.LoadAll([]string{filename, "?" + filename + "foo", filename + "bar"})
+	assert.Matches(t, err.Error(), "open.*bar: no such file or directory")
+}
+
 func TestLoadReader(t *testing.T) {
 	tf := make(tempFiles, 0)
 	defer tf.removeAll()
@@ -181,6 +344,506 @@ func TestLoadReader(t *testing.T) {
 	assertKeyValues(t, "", p, "key", "value")
 }
 
+func TestLoadSection(t *testing.T) {
+	blob := []byte("\x00\x01binary\x02key=value\nkey2=value2\n\xff\xfetrailer")
+	l := &Loader{Encoding: UTF8}
+	p, err := l.LoadSection(bytes.NewReader(blob), 9, 22)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"key", "key2"})
+	assertKeyValues(t, "", p, "key", "value", "key2", "value2")
+
+	p, err = l.LoadSection(bytes.NewReader(blob), 19, 12)
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key2", "value2")
+
+	// sections beyond the end are truncated
+	p, err = l.LoadSection(bytes.NewReader([]byte("a=1")), 0, 1000)
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "a", "1")
+}
+
+func TestLoadDelimiter(t *testing.T) {
+	l := &Loader{Encoding: UTF8, Delimiter: "=>"}
+	p, err := l.LoadBytes([]byte("a => b\nc=>d\ne>f => g\nh > i\nj = k"))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "a", "b", "c", "d", "e>f", "g", "h", "> i", "j", "k")
+}
+
+func TestLoadIgnoreCase(t *testing.T) {
+	l := &Loader{Encoding: UTF8, IgnoreCase: true}
+	p, err := l.LoadBytes([]byte("# comment\nDB.Host=h\nport=1"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("db.host"), "h")
+	assert.Equal(t, p.MustGet("DB.HOST"), "h")
+	assert.Equal(t, p.GetComment("db.host"), "comment")
+	assert.Equal(t, p.Keys(), []string{"DB.Host", "port"})
+
+	p.MustSet("Web.Port", "80")
+	p.MustSet("db.HOST", "h2")
+	assert.Equal(t, p.MustGet("web.port"), "80")
+	assert.Equal(t, p.Keys(), []string{"DB.Host", "port", "Web.Port"})
+
+	buf := new(bytes.Buffer)
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "DB.Host = h2\nport = 1\nWeb.Port = 80\n")
+
+	p.Delete("DB.HOST")
+	assert.Equal(t, p.Keys(), []string{"port", "Web.Port"})
+}
+
+func TestLoadIgnoreCaseHelpers(t *testing.T) {
+	l := &Loader{Encoding: UTF8, IgnoreCase: true}
+	p, err := l.LoadBytes([]byte("DB.Host=h\nDB.Port=1\nurl=${db.HOST}:${DB.port}\nStraße.1=a\nSTRASSE.2=b"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("url"), "h:1")
+	assert.Equal(t, p.UnresolvedRefs(), []string(nil))
+
+	pp := p.FilterPrefix("db.")
+	assert.Equal(t, pp.Keys(), []string{"DB.Host", "DB.Port"})
+	assert.Equal(t, pp.MustGet("db.host"), "h")
+	assert.Equal(t, p.FilterStripPrefix("DB.").Keys(), []string{"Host", "Port"})
+	assert.Equal(t, p.FilterStripPrefix("strasse.").Keys(), []string{"1", "2"})
+	assert.Equal(t, p.FilterRegexp(regexp.MustCompile(`^DB\.`)).Keys(), []string{"DB.Host", "DB.Port"})
+	assert.Equal(t, p.CountPrefix("db."), 2)
+	assert.Equal(t, p.CountFunc(func(k, v string) bool { return strings.HasPrefix(k, "DB.") }), 2)
+	assert.Equal(t, p.GetConcat("strasse."), "ab")
+
+	var keys []string
+	p.ForEachPrefix("Db.", func(k, v string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	assert.Equal(t, keys, []string{"DB.Host", "DB.Port"})
+
+	m := p.Map()
+	assert.Equal(t, m["DB.Host"], "h")
+	_, ok := m["db.host"]
+	assert.Equal(t, ok, false)
+}
+
+func TestLoadIgnoreCaseUnicode(t *testing.T) {
+	l := &Loader{Encoding: UTF8, IgnoreCase: true}
+	p, err := l.LoadBytes([]byte("Straße=a\nİstanbul=b\nırmak=c\nΣΟΦΟΣ=d\nKelvin=e"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"Straße", "İstanbul", "ırmak", "ΣΟΦΟΣ", "Kelvin"})
+
+	tests := []struct {
+		key, value string
+	}{
+		{"STRASSE", "a"}, {"strasse", "a"}, {"STRAẞE", "a"}, {"straße", "a"},
+		{"istanbul", "b"}, {"İSTANBUL", "b"},
+		{"ırmak", "c"}, {"IRMAK", ""}, {"irmak", ""},
+		{"σοφος", "d"}, {"σοφοσ", "d"},
+		{"kelvin", "e"}, {"\u212Aelvin", "e"},
+	}
+	for _, test := range tests {
+		v, _ := p.Get(test.key)
+		assert.Equal(t, v, test.value, test.key)
+	}
+}
+
+func TestLoadFSGlob(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf.d/20-b.properties": {Data: []byte("key=b\nkey2=${key}")},
+		"conf.d/10-a.properties": {Data: []byte("key=a\nkey1=a")},
+		"conf.d/30-c.properties": {Data: []byte("key3=c")},
+		"conf.d/README":          {Data: []byte("key=readme")},
+		"other/40-d.properties":  {Data: []byte("key=d")},
+	}
+	l := &Loader{Encoding: UTF8}
+	p, err := l.LoadFSGlob(fsys, "conf.d/*.properties")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"key", "key1", "key2", "key3"})
+	assertKeyValues(t, "", p, "key", "b", "key1", "a", "key2", "b", "key3", "c")
+	src, _ := p.Source("key")
+	assert.Equal(t, src, "conf.d/20-b.properties")
+	src, _ = p.Source("key1")
+	assert.Equal(t, src, "conf.d/10-a.properties")
+
+	p, err = l.LoadFSGlob(fsys, "none/*")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Len(), 0)
+
+	_, err = l.LoadFSGlob(fsys, "[")
+	assert.Matches(t, err.Error(), "syntax error in pattern")
+}
+
+func TestLoaderPlan(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	filename := tf.makeFile("key=value")
+	srv := testServer()
+	defer srv.Close()
+
+	l := &Loader{Encoding: UTF8}
+	plans, err := l.Plan([]string{filename, "?" + filename + "foo", srv.URL + "/a", srv.URL + "/c"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, plans, []SourcePlan{
+		{Name: filename, Resolved: filename, Type: "file", Exists: true},
+		{Name: "?" + filename + "foo", Resolved: filename + "foo", Type: "file", Optional: true},
+		{Name: srv.URL + "/a", Resolved: srv.URL + "/a", Type: "url", Exists: true},
+		{Name: srv.URL + "/c", Resolved: srv.URL + "/c", Type: "url"},
+	})
+
+	_, err = l.Plan([]string{"${HOME"})
+	assert.Matches(t, err.Error(), "malformed expression")
+}
+
+func TestLoadNormalizeNewlines(t *testing.T) {
+	input := "key = line1\\r\\n\\\r\n    line2\\r\\\r\n    line3\r\nkey2 = value\r\n"
+	p, err := Load([]byte(input), UTF8)
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, input, p, "key", "line1\r\nline2\rline3", "key2", "value")
+
+	l := &Loader{Encoding: UTF8, NormalizeNewlines: true}
+	p, err = l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, input, p, "key", "line1\nline2\nline3", "key2", "value")
+}
+
+func TestLoadRequireExplicitDelimiter(t *testing.T) {
+	l := &Loader{Encoding: UTF8, RequireExplicitDelimiter: true}
+	p, err := l.LoadBytes([]byte("a=1\nb : 2\nc\nd\\ x=3\ne=\n"))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "a", "1", "b", "2", "c", "", "d x", "3", "e", "")
+
+	_, err = l.LoadBytes([]byte("a=1\nkey value\n"))
+	assert.Equal(t, err.Error(), "properties: Line 2: missing delimiter after key")
+
+	_, err = l.LoadBytes([]byte("key\tvalue"))
+	assert.Matches(t, err.Error(), "missing delimiter")
+
+	l.Delimiter = "=>"
+	p, err = l.LoadBytes([]byte("a => 1"))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "a", "1")
+
+	// whitespace is a valid delimiter by default
+	p, err = LoadString("key value")
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value")
+}
+
+func TestLoadExpandOnLoad(t *testing.T) {
+	input := "host=h\nurl=http://${host}/${path}\npath=p"
+	l := &Loader{Encoding: UTF8, ExpandOnLoad: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.DisableExpansion, true)
+	assert.Equal(t, p.Map()["url"], "http://h/p")
+	assertKeyValues(t, input, p, "host", "h", "url", "http://h/p", "path", "p")
+
+	_, err = l.LoadBytes([]byte("a=${b}\nb=${a}"))
+	assert.Matches(t, err.Error(), "circular reference")
+
+	_, err = l.LoadBytes([]byte("a=${b"))
+	assert.Matches(t, err.Error(), "malformed expression")
+
+	// references across files are expanded after merging
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+	filename := tf.makeFile("url=http://${host}")
+	filename2 := tf.makeFile("host=h2")
+	p, err = l.LoadAll([]string{filename, filename2})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Map(), map[string]string{"url": "http://h2", "host": "h2"})
+}
+
+func TestLoadRespectQuotes(t *testing.T) {
+	input := `a = "  spaced  "
+b = "say \"hi\""  
+c =   plain  "x"
+d = ""
+e = "one \
+     two"
+f = "x\ty"`
+	l := &Loader{Encoding: UTF8, RespectQuotes: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, input, p, "a", "  spaced  ", "b", `say "hi"`, "c", `plain  "x"`, "d", "", "e", "one two", "f", "x\ty")
+
+	_, err = l.LoadBytes([]byte("a = \"open\nb = c"))
+	assert.Equal(t, err.Error(), "properties: Line 1: unterminated quoted value")
+
+	_, err = l.LoadBytes([]byte(`a = "open`))
+	assert.Matches(t, err.Error(), "unterminated quoted value")
+
+	_, err = l.LoadBytes([]byte(`a = "x" y`))
+	assert.Matches(t, err.Error(), "unexpected text after quoted value")
+
+	// quotes are part of the value by default
+	p, err = LoadString(`a = "  spaced  "`)
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "a", `"  spaced  "`)
+}
+
+func TestMustLoadReturningHandler(t *testing.T) {
+	var errs []error
+	ErrorHandler = func(err error) { errs = append(errs, err) }
+	defer func() { ErrorHandler = PanicHandler }()
+
+	p := MustLoadString("key=${key")
+	assert.Equal(t, len(errs), 1)
+	assert.Matches(t, errs[0].Error(), "malformed expression")
+	assert.Equal(t, p != nil, true)
+	assert.Equal(t, p.Len(), 0)
+	p.MustSet("key", "value")
+
+	p = MustLoadFile("doesnotexist.properties", UTF8)
+	assert.Equal(t, len(errs), 2)
+	assert.Equal(t, p.Len(), 0)
+}
+
+func TestLoadMaxBytes(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+	filename := tf.makeFile("key=value")
+	srv := testServer()
+	defer srv.Close()
+
+	l := &Loader{Encoding: UTF8, MaxBytes: 9}
+	p, err := l.LoadFile(filename)
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value")
+	p, err = l.LoadURL(srv.URL + "/a")
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value")
+	p, err = l.LoadReader(strings.NewReader("key=value"))
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "key", "value")
+
+	l.MaxBytes = 8
+	_, err = l.LoadFile(filename)
+	assert.Equal(t, err.Error(), "properties: input exceeds limit of 8 bytes")
+	_, err = l.LoadURL(srv.URL + "/a")
+	assert.Matches(t, err.Error(), "input exceeds limit of 8 bytes")
+	_, err = l.LoadReader(strings.NewReader("key=value"))
+	assert.Equal(t, err.Error(), "properties: input exceeds limit of 8 bytes")
+
+	l.IgnoreMissing = true
+	p, err = l.LoadFile(filename + "missing")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Len(), 0)
+}
+
+func TestLoadSections(t *testing.T) {
+	input := `top = t
+# database
+[db]
+host = h
+[ web ]
+port = 80
+[db]
+port = 5432
+host = h2
+[]
+other = o
+`
+	l := &Loader{Encoding: UTF8, Sections: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"top", "db.host", "web.port", "db.port", "other"})
+	assertKeyValues(t, input, p, "top", "t", "db.host", "h2", "web.port", "80", "db.port", "5432", "other", "o")
+	assert.Equal(t, p.GetComment("db.host"), "database")
+
+	_, err = l.LoadBytes([]byte("[db\nhost=h"))
+	assert.Equal(t, err.Error(), "properties: Line 1: unterminated section")
+	_, err = l.LoadBytes([]byte("[db] x"))
+	assert.Matches(t, err.Error(), "unexpected text after section")
+
+	// brackets are part of the key by default
+	p, err = LoadString("[db]\nhost=h")
+	assert.Equal(t, err, nil)
+	assertKeyValues(t, "", p, "[db]", "", "host", "h")
+}
+
+func TestLazyLoadFile(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	filename := tf.makeFile("")
+	assert.Equal(t, os.Remove(filename), nil)
+
+	// the file is not read until first access
+	p := LazyLoadFile(filename, UTF8)
+	assert.Equal(t, os.WriteFile(filename, []byte("key=value\nother=${key}"), 0600), nil)
+	assert.Equal(t, p.Len(), 2)
+	assert.Equal(t, p.MustGet("other"), "value")
+	assert.Equal(t, p.Err(), nil)
+
+	// the result is cached
+	assert.Equal(t, os.WriteFile(filename, []byte("key=changed"), 0600), nil)
+	assert.Equal(t, p.MustGet("key"), "value")
+
+	// all accessors read the file
+	for _, f := range []func(p *Properties) interface{}{
+		func(p *Properties) interface{} { return p.FilterPrefix("ke").Keys() },
+		func(p *Properties) interface{} { return p.CountPrefix("ke") },
+		func(p *Properties) interface{} { return p.AsEnviron("") },
+		func(p *Properties) interface{} { return string(p.Bytes()) },
+		func(p *Properties) interface{} { n, _ := p.Source("key"); return n },
+	} {
+		want := f(MustLoadFile(filename, UTF8))
+		assert.Equal(t, f(LazyLoadFile(filename, UTF8)), want)
+	}
+
+	// concurrent readers wait for the file
+	p = LazyLoadFile(filename, UTF8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, _ := p.Get("key"); v != "changed" {
+				t.Errorf("got %q want %q", v, "changed")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLazyLoadFileError(t *testing.T) {
+	p := LazyLoadFile("doesnotexist.properties", UTF8)
+
+	// only Err and the Must functions report the error
+	assert.Equal(t, p.Len(), 0)
+	v, ok := p.Get("key")
+	assert.Equal(t, v, "")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, p.GetString("key", "def"), "def")
+	assert.Equal(t, p.Keys(), []string{})
+	assert.Matches(t, p.Err().Error(), "no such file or directory")
+	assert.Panic(t, func() { p.MustGet("key") }, "no such file or directory")
+	assert.Panic(t, func() { p.MustGetInt("key") }, "no such file or directory")
+}
+
+func TestLoadKeepKeyWhitespace(t *testing.T) {
+	input := "key = a\n  my key  = b\nesc\\  = c\ntab\\\t:d\n"
+
+	p, err := LoadString(input)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"key", "my", "esc ", "tab\t"})
+	assert.Equal(t, p.MustGet("key"), "a")
+	assert.Equal(t, p.MustGet("my"), "key  = b")
+	assert.Equal(t, p.MustGet("esc "), "c")
+	assert.Equal(t, p.MustGet("tab\t"), "d")
+
+	l := &Loader{Encoding: UTF8, KeepKeyWhitespace: true}
+	p, err = l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"key ", "my key  ", "esc  ", "tab\t"})
+	assert.Equal(t, p.MustGet("key "), "a")
+	assert.Equal(t, p.MustGet("my key  "), "b")
+	assert.Equal(t, p.MustGet("esc  "), "c")
+	assert.Equal(t, p.MustGet("tab\t"), "d")
+}
+
+func TestResolvePath(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	abs, err := filepath.Abs("/etc/app.conf")
+	assert.Equal(t, err, nil)
+	filename := tf.makeFile("rel=../data/./db.sqlite\nabs=" + filepath.ToSlash(abs) + "\nempty=\n")
+	p := MustLoadFile(filename, UTF8)
+	p.MustSet("set", "x")
+	dir := filepath.Dir(filename)
+
+	for _, test := range []struct {
+		key  string
+		path string
+		ok   bool
+	}{
+		{"rel", filepath.Join(dir, "..", "data", "db.sqlite"), true},
+		{"abs", abs, true},
+		{"empty", "", true},
+		{"set", "x", true},
+		{"missing", "", false},
+	} {
+		path, ok := p.ResolvePath(test.key)
+		assert.Equal(t, path, test.path, test.key)
+		assert.Equal(t, ok, test.ok, test.key)
+	}
+
+	// the loader records the file as source
+	p, err = (&Loader{Encoding: UTF8}).LoadFile(filename)
+	assert.Equal(t, err, nil)
+	path, ok := p.ResolvePath("rel")
+	assert.Equal(t, path, filepath.Join(dir, "..", "data", "db.sqlite"))
+	assert.Equal(t, ok, true)
+}
+
+func TestLoadCommentCharInContinuation(t *testing.T) {
+	input := "key = a \\\n    # not a comment \\\n    ! neither\n# comment\nkey2 = #value"
+	for _, strict := range []bool{false, true} {
+		l := &Loader{Encoding: UTF8, StrictComments: strict}
+		p, err := l.LoadBytes([]byte(input))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, p.Keys(), []string{"key", "key2"})
+		assert.Equal(t, p.MustGet("key"), "a # not a comment ! neither")
+		assert.Equal(t, p.MustGet("key2"), "#value")
+		assert.Equal(t, p.GetComments("key2"), []string{"comment"})
+	}
+}
+
+func TestLoadStrictComments(t *testing.T) {
+	input := "# comment\n  # indented = 1\n\t!bang = 2\r\n! comment"
+
+	p, err := LoadString(input)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Len(), 0)
+
+	l := &Loader{Encoding: UTF8, StrictComments: true}
+	p, err = l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"#", "!bang"})
+	assert.Equal(t, p.MustGet("#"), "indented = 1")
+	assert.Equal(t, p.MustGet("!bang"), "2")
+	assert.Equal(t, p.GetComments("#"), []string{"comment"})
+}
+
+func TestReloadOnKeyChange(t *testing.T) {
+	tf := make(tempFiles, 0)
+	defer tf.removeAll()
+
+	filename := tf.makeFile("a = 1\nb = 2\nc = 3\n")
+	p := MustLoadFile(filename, UTF8)
+
+	type change struct{ key, old, new string }
+	var changes []change
+	for _, key := range []string{"a", "b", "c", "d"} {
+		key := key
+		p.OnKeyChange(key, func(old, new string) {
+			changes = append(changes, change{key, old, new})
+		})
+	}
+
+	assert.Equal(t, p.Reload(), nil)
+	assert.Equal(t, len(changes), 0)
+
+	assert.Equal(t, os.WriteFile(filename, []byte("a = 1\nb = 20\n"), 0600), nil)
+	assert.Equal(t, p.Reload(), nil)
+	assert.Equal(t, changes, []change{{"b", "2", "20"}, {"c", "3", ""}})
+	assert.Equal(t, p.Keys(), []string{"a", "b"})
+
+	changes = nil
+	assert.Equal(t, os.WriteFile(filename, []byte("a = 1\nb = 20\nd = ${a}\n"), 0600), nil)
+	assert.Equal(t, p.Reload(), nil)
+	assert.Equal(t, changes, []change{{"d", "", "${a}"}})
+	assert.Equal(t, p.MustGet("d"), "1")
+
+	// errors keep the properties unchanged
+	changes = nil
+	assert.Equal(t, os.Remove(filename), nil)
+	assert.Matches(t, p.Reload().Error(), "no such file or directory")
+	assert.Equal(t, p.Keys(), []string{"a", "b", "d"})
+	assert.Equal(t, len(changes), 0)
+
+	assert.Equal(t, NewProperties().Reload().Error(), "properties: no sources to reload")
+}
+
 type tempFiles []string
 
 func (tf *tempFiles) removeAll() {
@@ -7,6 +7,7 @@ package properties
 import (
 	"fmt"
 	"runtime"
+	"strings"
 )
 
 type parser struct {
@@ -14,23 +15,50 @@ type parser struct {
 }
 
 func parse(input string) (properties *Properties, err error) {
-	p := &parser{lex: lex(input)}
+	return parseOpts(input, lexOptions{})
+}
+
+func parseOpts(input string, opts lexOptions) (properties *Properties, err error) {
+	p := &parser{lex: lex(input, opts)}
 	defer p.recover(&err)
 
 	properties = NewProperties()
-	key := ""
+	key, section := "", ""
 	comments := []string{}
+	commentChars := []string{}
+	commentPos := 0
+	preserve := p.lex.opts.preserveFormatting
+	properties.PreserveFormatting = preserve
 
 	for {
-		token := p.expectOneOf(itemComment, itemKey, itemEOF)
+		token := p.expectOneOf(itemComment, itemKey, itemSection, itemEOF)
 		switch token.typ {
 		case itemEOF:
+			if len(comments) > 0 {
+				properties.trailingComments = comments
+				properties.trailingBlank = blankLineBefore(input, commentPos)
+				if preserve {
+					properties.trailingCommentChars = commentChars
+				}
+			}
 			goto done
 		case itemComment:
+			if len(comments) == 0 {
+				commentPos = token.pos
+			}
 			comments = append(comments, token.val)
+			if preserve {
+				commentChars = append(commentChars, input[token.pos:token.pos+1])
+			}
+			continue
+		case itemSection:
+			section = token.val
 			continue
 		case itemKey:
 			key = token.val
+			if section != "" {
+				key = section + "." + key
+			}
 			if _, ok := properties.m[key]; !ok {
 				properties.k = append(properties.k, key)
 			}
@@ -40,6 +68,10 @@ func parse(input string) (properties *Properties, err error) {
 		if len(comments) > 0 {
 			properties.c[key] = comments
 			comments = []string{}
+			if preserve {
+				properties.setCommentChars(key, commentChars)
+				commentChars = []string{}
+			}
 		}
 		switch token.typ {
 		case itemEOF:
@@ -47,6 +79,9 @@ func parse(input string) (properties *Properties, err error) {
 			goto done
 		case itemValue:
 			properties.m[key] = token.val
+			if preserve {
+				properties.setRawText(key, token.raw, token.val)
+			}
 		}
 	}
 
@@ -54,6 +89,17 @@ done:
 	return properties, nil
 }
 
+// blankLineBefore reports whether the line which contains pos is preceded
+// by an empty line.
+func blankLineBefore(input string, pos int) bool {
+	s := strings.TrimRight(input[:pos], " \t\f")
+	if !strings.HasSuffix(s, "\n") {
+		return false
+	}
+	s = strings.TrimRight(s[:len(s)-1], " \t\f\r")
+	return strings.HasSuffix(s, "\n")
+}
+
 func (p *parser) errorf(format string, args ...interface{}) {
 	format = fmt.Sprintf("properties: Line %d: %s", p.lex.lineNumber(), format)
 	panic(fmt.Errorf(format, args...))
@@ -4,28 +4,34 @@
 
 package properties
 
-// BUG(frank): Set() does not check for invalid unicode literals since this is currently handled by the lexer.
-// BUG(frank): Write() does not allow to configure the newline character. Therefore, on Windows LF is used.
-
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
 const maxExpansionDepth = 64
 
 // ErrorHandlerFunc defines the type of function which handles failures
-// of the MustXXX() functions. An error handler function must exit
-// the application after handling the error.
+// of the MustXXX() functions. An error handler function should exit
+// the application after handling the error. If it returns, the MustLoadXXX()
+// functions return empty, non-nil properties.
 type ErrorHandlerFunc func(error)
 
 // ErrorHandler is the function which handles failures of the MustXXX()
@@ -53,7 +59,12 @@ func PanicHandler(err error) {
 // A Properties contains the key/value pairs from the properties input.
 // All values are stored in unexpanded form and are expanded at runtime
 type Properties struct {
-	// Pre-/Postfix for property expansion.
+	// Pre-/Postfix for property expansion. A backslash or the first
+	// character of the prefix directly before the prefix in a value
+	// escapes the expression, e.g. '$${key}' expands to '${key}'. Note
+	// that the loader removes single backslashes so that an expression
+	// escaped with a backslash must be written as '\\${key}' in a
+	// properties file.
 	Prefix  string
 	Postfix string
 
@@ -63,17 +74,141 @@ type Properties struct {
 	// not check for circular references on Get() or on Set().
 	DisableExpansion bool
 
+	// SelfRefFromEnv controls how a key is expanded which references
+	// itself directly or indirectly, e.g. 'PATH=${PATH}:/opt/bin'. By
+	// default this is reported as circular reference even if an
+	// environment variable with the same name exists. When set to true
+	// the reference is replaced with the value of the environment
+	// variable which is not expanded any further. If the environment
+	// variable does not exist the circular reference is still reported.
+	SelfRefFromEnv bool
+
+	// IgnoreCase controls whether keys are matched case-insensitively.
+	// When set to true keys are stored in case folded form but Keys(), String()
+	// and Write() return the keys in the case in which they were set.
+	// The keys in expressions and the prefixes of the filter and count
+	// functions are matched case-insensitively as well. Regular expressions
+	// and callbacks see the keys in the case in which they were set.
+	IgnoreCase bool
+
+	// PreserveFormatting controls whether Write reproduces the formatting
+	// details recorded by the loader. Comments are written with their
+	// original comment character '#' or '!'. The loader also retains
+	// the original input which is returned by Bytes until the properties
+	// are modified.
+	PreserveFormatting bool
+
 	// Stores the key/value pairs
 	m map[string]string
 
 	// Stores the comments per key.
 	c map[string][]string
 
+	// Stores the comment characters per comment and key.
+	cc map[string][]string
+
 	// Stores the keys in order of appearance.
 	k []string
 
+	// Stores the original keys per case folded key if IgnoreCase is set.
+	names map[string]string
+
 	// WriteSeparator specifies the separator of key and value while writing the properties.
+	// It must consist of whitespace and at most one '=', ':' or Delimiter so
+	// that the written properties can be loaded again, e.g. "=", ": " or
+	// " => " with the Delimiter "=>". Otherwise, Write returns an error.
+	// The default is " = ".
 	WriteSeparator string
+
+	// Delimiter is the additional key/value delimiter of the loader which
+	// WriteSeparator can contain. See Loader.Delimiter.
+	Delimiter string
+
+	// MultilineValues controls whether values with newlines are written
+	// as multi-line values with continuation lines instead of a single
+	// line with escaped newlines.
+	MultilineValues bool
+
+	// EscapeNonASCII controls whether Write escapes all non-ASCII
+	// characters as unicode literals for UTF-8 output as well.
+	EscapeNonASCII bool
+
+	// DescriptionSuffix controls whether Write emits the value of the key
+	// with this suffix, e.g. "db.host.desc" for "db.host" with the suffix
+	// ".desc", as comment above the key. The description keys are not
+	// written themselves unless the described key does not exist.
+	DescriptionSuffix string
+
+	// AlignValues controls whether Write pads the keys with spaces
+	// so that the separators of all key/value pairs are aligned.
+	AlignValues bool
+
+	// Newline specifies the line separator which Write uses, e.g. "\r\n"
+	// for files on Windows. The default is "\n".
+	Newline string
+
+	// Stores the replacement keys of deprecated keys.
+	deprecated map[string]string
+
+	// Stores the deprecated keys for which a warning was logged.
+	warned map[string]bool
+
+	// Stores the input the properties were loaded from and its encoding
+	// if PreserveFormatting is set.
+	raw    []byte
+	rawEnc Encoding
+
+	// dirty is true if the properties were modified after loading.
+	dirty bool
+
+	// Stores the name of the file or URL per key which provided the value.
+	sources map[string]string
+
+	// TrackAccess controls whether the keys which are read with Get or
+	// one of the typed getters are recorded. The keys which have not been
+	// read are returned by Unused. Functions which read many keys at once
+	// like String, AsEnviron or GetMany do not record the keys. Recording
+	// the keys is safe for concurrent readers.
+	TrackAccess bool
+
+	// Stores the keys which were read or touched.
+	accessed map[string]bool
+
+	// Stores the original text and the value per key if PreserveFormatting
+	// is set.
+	rawTexts map[string]rawText
+
+	// Stores the comments after the last key, their comment characters if
+	// PreserveFormatting is set and whether they are preceded by an empty
+	// line.
+	trailingComments     []string
+	trailingCommentChars []string
+	trailingBlank        bool
+
+	// lazy loads the properties on first access if set.
+	lazy *lazyLoad
+
+	// Stores the encoding per key which is used by Write instead of
+	// the encoding passed to Write.
+	encodings map[string]Encoding
+
+	// validator is called by Set for every new entry.
+	validator func(key, value string) error
+
+	// cache stores the expanded values if EnableExpansionCache was called.
+	cache *expansionCache
+
+	// reload loads the properties again from their sources if set.
+	reload func() (*Properties, error)
+
+	// Stores the callbacks per key which are called by Reload.
+	watchers map[string][]func(old, new string)
+}
+
+// rawText is the original text of a value in the input.
+type rawText struct {
+	text  string
+	value string
 }
 
 // NewProperties creates a new Properties struct with the default
@@ -90,7 +225,7 @@ func NewProperties() *Properties {
 
 // Load reads a buffer into the given Properties struct.
 func (p *Properties) Load(buf []byte, enc Encoding) error {
-	l := &Loader{Encoding: enc, DisableExpansion: p.DisableExpansion}
+	l := &Loader{Encoding: enc, DisableExpansion: p.DisableExpansion, IgnoreCase: p.IgnoreCase}
 	newProperties, err := l.LoadBytes(buf)
 	if err != nil {
 		return err
@@ -102,29 +237,150 @@ func (p *Properties) Load(buf []byte, enc Encoding) error {
 // Get returns the expanded value for the given key if exists.
 // Otherwise, ok is false.
 func (p *Properties) Get(key string) (value string, ok bool) {
+	if p.TrackAccess {
+		p.touch(p.normKey(key))
+	}
+	return p.get(key)
+}
+
+// get returns the expanded value for the given key like Get
+// without recording the access.
+func (p *Properties) get(key string) (value string, ok bool) {
+	value, ok, err := p.lookup(key)
+
+	// we guarantee that the expanded value is free of
+	// circular references and malformed expressions
+	// so we panic if we still get an error here.
+	if err != nil {
+		ErrorHandler(err)
+	}
+
+	return value, ok
+}
+
+// lookup returns the expanded value for the given key and
+// the error of the expansion.
+func (p *Properties) lookup(key string) (value string, ok bool, err error) {
+	p.resolve()
+	key = p.normKey(key)
+	if newKey, ok := p.deprecated[key]; ok {
+		p.warnDeprecated(key)
+		if _, ok := p.m[newKey]; ok {
+			key = newKey
+		}
+	}
+
 	v, ok := p.m[key]
 	if p.DisableExpansion {
-		return v, ok
+		return v, ok, nil
 	}
 	if !ok {
-		return "", false
+		return "", false, nil
 	}
 
+	if p.cache != nil {
+		expanded, err := p.cache.expand(p, key, v)
+		return expanded, true, err
+	}
 	expanded, err := p.expand(key, v)
+	return expanded, true, err
+}
 
-	// we guarantee that the expanded value is free of
-	// circular references and malformed expressions
-	// so we panic if we still get an error here.
+// EnableExpansionCache enables caching of the expanded values so that
+// repeated reads of values with expressions do not expand them again.
+// The cache is cleared when the values are modified, e.g. with Set,
+// Delete or Merge, or when the expansion settings change. Changes of
+// environment variables are not detected. The cache can be used by
+// concurrent readers.
+func (p *Properties) EnableExpansionCache() {
+	if p.cache == nil {
+		p.cache = &expansionCache{}
+	}
+}
+
+// invalidate clears the cache of expanded values.
+func (p *Properties) invalidate() {
+	if p.cache != nil {
+		p.cache.clear()
+	}
+}
+
+// expansionCache stores the expanded values per key together with the
+// settings they were expanded with.
+type expansionCache struct {
+	mu             sync.RWMutex
+	values         map[string]string
+	prefix         string
+	postfix        string
+	selfRefFromEnv bool
+}
+
+// expand returns the cached expanded value for key or expands and caches
+// the value. Values which cannot be expanded are not cached.
+func (c *expansionCache) expand(p *Properties, key, value string) (string, error) {
+	c.mu.RLock()
+	expanded, ok := c.values[key]
+	valid := c.prefix == p.Prefix && c.postfix == p.Postfix && c.selfRefFromEnv == p.SelfRefFromEnv
+	c.mu.RUnlock()
+	if ok && valid {
+		return expanded, nil
+	}
+
+	expanded, err := p.expand(key, value)
 	if err != nil {
-		ErrorHandler(err)
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil || c.prefix != p.Prefix || c.postfix != p.Postfix || c.selfRefFromEnv != p.SelfRefFromEnv {
+		c.values = map[string]string{}
+		c.prefix, c.postfix, c.selfRefFromEnv = p.Prefix, p.Postfix, p.SelfRefFromEnv
+	}
+	c.values[key] = expanded
+	return expanded, nil
+}
+
+// clear removes all cached values.
+func (c *expansionCache) clear() {
+	c.mu.Lock()
+	c.values = nil
+	c.mu.Unlock()
+}
+
+// TryGet returns the expanded value for the given key like Get but
+// returns an error instead of calling the ErrorHandler if the value
+// cannot be expanded, e.g. because of a circular reference which was
+// set while expansion was disabled. If the key does not exist an
+// error is returned as well.
+func (p *Properties) TryGet(key string) (string, error) {
+	if p.TrackAccess {
+		p.touch(p.normKey(key))
+	}
+	value, ok, err := p.lookup(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", invalidKeyError(key)
 	}
+	return value, nil
+}
 
-	return expanded, true
+// Has returns true if the key exists. Unlike Get the value is not
+// expanded so that Has returns true even if the value contains a
+// circular reference or a malformed expression. Has does not record
+// the access if TrackAccess is set.
+func (p *Properties) Has(key string) bool {
+	p.resolve()
+	_, ok := p.m[p.normKey(key)]
+	return ok
 }
 
 // MustGet returns the expanded value for the given key if exists.
 // Otherwise, it panics.
 func (p *Properties) MustGet(key string) string {
+	p.mustResolve()
 	if v, ok := p.Get(key); ok {
 		return v
 	}
@@ -134,15 +390,65 @@ func (p *Properties) MustGet(key string) string {
 
 // ----------------------------------------------------------------------------
 
-// ClearComments removes the comments for all keys.
+// Deprecate marks oldKey as deprecated in favor of newKey. A warning is
+// logged via LogPrintf once if oldKey is defined or when it is read. Reads
+// of oldKey return the value of newKey if newKey exists.
+func (p *Properties) Deprecate(oldKey, newKey string) {
+	p.resolve()
+	if p.deprecated == nil {
+		p.deprecated = map[string]string{}
+	}
+	oldKey, newKey = p.normKey(oldKey), p.normKey(newKey)
+	p.deprecated[oldKey] = newKey
+	if _, ok := p.m[oldKey]; ok {
+		p.warnDeprecated(oldKey)
+	}
+}
+
+// warnDeprecated logs a warning for a deprecated key once.
+func (p *Properties) warnDeprecated(key string) {
+	trackMu.Lock()
+	warned := p.warned[key]
+	if !warned {
+		if p.warned == nil {
+			p.warned = map[string]bool{}
+		}
+		p.warned[key] = true
+	}
+	trackMu.Unlock()
+	if warned {
+		return
+	}
+	LogPrintf("properties: %s is deprecated, use %s", key, p.deprecated[key])
+}
+
+// ----------------------------------------------------------------------------
+
+// ClearComments removes the comments for all keys. WriteComment and Bytes
+// then emit only the key/value lines even if the properties were loaded
+// with PreserveFormatting.
 func (p *Properties) ClearComments() {
+	p.resolve()
 	p.c = map[string][]string{}
+	p.cc = nil
+	p.trailingComments, p.trailingCommentChars, p.trailingBlank = nil, nil, false
+	p.dirty = true
+}
+
+// ----------------------------------------------------------------------------
+
+// StripComments removes all comments including the comments after the last
+// key like ClearComments so that Write emits only the key/value lines.
+func (p *Properties) StripComments() {
+	p.ClearComments()
 }
 
 // ----------------------------------------------------------------------------
 
 // GetComment returns the last comment before the given key or an empty string.
 func (p *Properties) GetComment(key string) string {
+	p.resolve()
+	key = p.normKey(key)
 	comments, ok := p.c[key]
 	if !ok || len(comments) == 0 {
 		return ""
@@ -154,6 +460,8 @@ func (p *Properties) GetComment(key string) string {
 
 // GetComments returns all comments that appeared before the given key or nil.
 func (p *Properties) GetComments(key string) []string {
+	p.resolve()
+	key = p.normKey(key)
 	if comments, ok := p.c[key]; ok {
 		return comments
 	}
@@ -162,9 +470,14 @@ func (p *Properties) GetComments(key string) []string {
 
 // ----------------------------------------------------------------------------
 
-// SetComment sets the comment for the key.
+// SetComment sets the comment for the key. The key does not have to exist
+// yet so that comments can be set before the value.
 func (p *Properties) SetComment(key, comment string) {
+	p.resolve()
+	key = p.normKey(key)
 	p.c[key] = []string{comment}
+	delete(p.cc, key)
+	p.dirty = true
 }
 
 // ----------------------------------------------------------------------------
@@ -172,6 +485,10 @@ func (p *Properties) SetComment(key, comment string) {
 // SetComments sets the comments for the key. If the comments are nil then
 // all comments for this key are deleted.
 func (p *Properties) SetComments(key string, comments []string) {
+	p.resolve()
+	key = p.normKey(key)
+	delete(p.cc, key)
+	p.dirty = true
 	if comments == nil {
 		delete(p.c, key)
 		return
@@ -179,6 +496,29 @@ func (p *Properties) SetComments(key string, comments []string) {
 	p.c[key] = comments
 }
 
+// setCommentChars records the comment characters of the comments for the key.
+func (p *Properties) setCommentChars(key string, chars []string) {
+	if p.cc == nil {
+		p.cc = map[string][]string{}
+	}
+	p.cc[key] = chars
+}
+
+// commentPrefix returns the prefix for writing the i-th comment with the
+// given comment characters. If formatting is preserved the original comment
+// character is used.
+func (p *Properties) commentPrefix(chars []string, i int, prefix string) string {
+	if p.PreserveFormatting {
+		if i < len(chars) {
+			return chars[i] + " "
+		}
+		if prefix == "" {
+			return "# "
+		}
+	}
+	return prefix
+}
+
 // ----------------------------------------------------------------------------
 
 // GetBool checks if the expanded value is one of '1', 'yes',
@@ -196,6 +536,7 @@ func (p *Properties) GetBool(key string, def bool) bool {
 // 'true' or 'on' if the key exists. The comparison is case-insensitive.
 // If the key does not exist the function panics.
 func (p *Properties) MustGetBool(key string) bool {
+	p.mustResolve()
 	v, err := p.getBool(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -203,6 +544,14 @@ func (p *Properties) MustGetBool(key string) bool {
 	return v
 }
 
+// GetBoolE checks if the expanded value is one of '1', 'yes',
+// 'true' or 'on' if the key exists. The comparison is case-insensitive.
+// All other values are false. If the key does not exist an error is
+// returned.
+func (p *Properties) GetBoolE(key string) (bool, error) {
+	return p.getBool(key)
+}
+
 func (p *Properties) getBool(key string) (value bool, err error) {
 	if v, ok := p.Get(key); ok {
 		return boolVal(v), nil
@@ -232,6 +581,7 @@ func (p *Properties) GetDuration(key string, def time.Duration) time.Duration {
 // the key exists. If key does not exist or the value cannot be parsed the
 // function panics. In almost all cases you want to use MustGetParsedDuration().
 func (p *Properties) MustGetDuration(key string) time.Duration {
+	p.mustResolve()
 	v, err := p.getInt64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -239,6 +589,14 @@ func (p *Properties) MustGetDuration(key string) time.Duration {
 	return time.Duration(v)
 }
 
+// GetDurationE parses the expanded value as an time.Duration (in ns) if
+// the key exists. If key does not exist or the value cannot be parsed an
+// error is returned. In almost all cases you want to use GetParsedDurationE().
+func (p *Properties) GetDurationE(key string) (time.Duration, error) {
+	v, err := p.getInt64(key)
+	return time.Duration(v), err
+}
+
 // ----------------------------------------------------------------------------
 
 // GetParsedDuration parses the expanded value with time.ParseDuration() if the key exists.
@@ -259,6 +617,7 @@ func (p *Properties) GetParsedDuration(key string, def time.Duration) time.Durat
 // MustGetParsedDuration parses the expanded value with time.ParseDuration() if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetParsedDuration(key string) time.Duration {
+	p.mustResolve()
 	s, ok := p.Get(key)
 	if !ok {
 		ErrorHandler(invalidKeyError(key))
@@ -270,6 +629,57 @@ func (p *Properties) MustGetParsedDuration(key string) time.Duration {
 	return v
 }
 
+// GetParsedDurationE parses the expanded value with time.ParseDuration() if
+// the key exists. If key does not exist or the value cannot be parsed an
+// error is returned.
+func (p *Properties) GetParsedDurationE(key string) (time.Duration, error) {
+	s, ok := p.Get(key)
+	if !ok {
+		return 0, invalidKeyError(key)
+	}
+	return time.ParseDuration(s)
+}
+
+// GetDurationInRange parses the expanded value as a time.Duration (in the
+// format accepted by time.ParseDuration) if the key exists. If key does not
+// exist, the value cannot be parsed or is outside of [min, max] the default
+// value is returned.
+func (p *Properties) GetDurationInRange(key string, def, min, max time.Duration) time.Duration {
+	v, err := p.getDurationInRange(key, min, max)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetDurationInRange parses the expanded value as a time.Duration (in
+// the format accepted by time.ParseDuration) if the key exists. If key does
+// not exist, the value cannot be parsed or is outside of [min, max] the
+// function panics.
+func (p *Properties) MustGetDurationInRange(key string, min, max time.Duration) time.Duration {
+	p.mustResolve()
+	v, err := p.getDurationInRange(key, min, max)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getDurationInRange(key string, min, max time.Duration) (value time.Duration, err error) {
+	s, ok := p.Get(key)
+	if !ok {
+		return 0, invalidKeyError(key)
+	}
+	value, err = time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("duration %s for key %s out of range [%s, %s]", value, key, min, max)
+	}
+	return value, nil
+}
+
 // ----------------------------------------------------------------------------
 
 // GetFloat64 parses the expanded value as a float64 if the key exists.
@@ -286,6 +696,7 @@ func (p *Properties) GetFloat64(key string, def float64) float64 {
 // MustGetFloat64 parses the expanded value as a float64 if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetFloat64(key string) float64 {
+	p.mustResolve()
 	v, err := p.getFloat64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -293,6 +704,12 @@ func (p *Properties) MustGetFloat64(key string) float64 {
 	return v
 }
 
+// GetFloat64E parses the expanded value as a float64 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetFloat64E(key string) (float64, error) {
+	return p.getFloat64(key)
+}
+
 func (p *Properties) getFloat64(key string) (value float64, err error) {
 	if v, ok := p.Get(key); ok {
 		value, err = strconv.ParseFloat(v, 64)
@@ -306,6 +723,56 @@ func (p *Properties) getFloat64(key string) (value float64, err error) {
 
 // ----------------------------------------------------------------------------
 
+// GetLocalizedFloat64 parses the expanded value as a float64 with dec as
+// decimal separator and grp as grouping separator if the key exists, e.g.
+// "1.000,5" with dec=',' and grp='.'. If key does not exist or the value
+// cannot be parsed the default value is returned.
+func (p *Properties) GetLocalizedFloat64(key string, dec, grp rune, def float64) float64 {
+	v, err := p.getLocalizedFloat64(key, dec, grp)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetLocalizedFloat64 parses the expanded value as a float64 with dec as
+// decimal separator and grp as grouping separator if the key exists. If key
+// does not exist or the value cannot be parsed the function panics.
+func (p *Properties) MustGetLocalizedFloat64(key string, dec, grp rune) float64 {
+	p.mustResolve()
+	v, err := p.getLocalizedFloat64(key, dec, grp)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getLocalizedFloat64(key string, dec, grp rune) (value float64, err error) {
+	if v, ok := p.Get(key); ok {
+		v = strings.Map(func(r rune) rune {
+			switch r {
+			case grp:
+				return -1
+			case dec:
+				return '.'
+			case '.':
+				// a '.' which is neither decimal nor grouping separator
+				return 'x'
+			default:
+				return r
+			}
+		}, v)
+		value, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, err
+		}
+		return value, nil
+	}
+	return 0, invalidKeyError(key)
+}
+
+// ----------------------------------------------------------------------------
+
 // GetFloat32 parses the expanded value as a float32 if the key exists.
 // If key does not exist or the value cannot be parsed the default
 // value is returned.
@@ -320,6 +787,7 @@ func (p *Properties) GetFloat32(key string, def float32) float32 {
 // MustGetFloat32 parses the expanded value as a float32 if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetFloat32(key string) float32 {
+	p.mustResolve()
 	v, err := p.getFloat32(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -327,6 +795,12 @@ func (p *Properties) MustGetFloat32(key string) float32 {
 	return v
 }
 
+// GetFloat32E parses the expanded value as a float32 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetFloat32E(key string) (float32, error) {
+	return p.getFloat32(key)
+}
+
 func (p *Properties) getFloat32(key string) (value float32, err error) {
 	if v, ok := p.Get(key); ok {
 		n, err := strconv.ParseFloat(v, 32)
@@ -340,6 +814,167 @@ func (p *Properties) getFloat32(key string) (value float32, err error) {
 
 // ----------------------------------------------------------------------------
 
+// GetThreshold parses the expanded value as a comparison operator followed
+// by a number, e.g. "> 80" or ">=0.5", if the key exists. Valid operators
+// are '>', '>=', '<', '<=' and '=='. If the key does not exist or the value
+// cannot be parsed ok is false.
+func (p *Properties) GetThreshold(key string) (op string, value float64, ok bool) {
+	op, value, err := p.getThreshold(key)
+	if err != nil {
+		return "", 0, false
+	}
+	return op, value, true
+}
+
+// MustGetThreshold parses the expanded value as a comparison operator
+// followed by a number if the key exists. If key does not exist or the
+// value cannot be parsed the function panics.
+func (p *Properties) MustGetThreshold(key string) (op string, value float64) {
+	p.mustResolve()
+	op, value, err := p.getThreshold(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return op, value
+}
+
+func (p *Properties) getThreshold(key string) (op string, value float64, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return "", 0, invalidKeyError(key)
+	}
+	v = strings.TrimSpace(v)
+	for _, o := range []string{">=", "<=", "==", ">", "<"} {
+		if strings.HasPrefix(v, o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return "", 0, fmt.Errorf("missing operator in threshold %q for key %s", v, key)
+	}
+	value, err = strconv.ParseFloat(strings.TrimSpace(v[len(op):]), 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return op, value, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// siExponents maps SI prefixes to the exponents of their decimal multipliers.
+var siExponents = map[rune]int{
+	'T': 12,
+	'G': 9,
+	'M': 6,
+	'k': 3,
+	'm': -3,
+	'µ': -6, // micro sign
+	'μ': -6, // greek small letter mu
+	'u': -6,
+	'n': -9,
+}
+
+// GetSIFloat parses the expanded value as a float64 with an optional SI
+// suffix if the key exists, e.g. "100k" or "2.5M". Supported suffixes are
+// T, G, M, k, m, µ (or u) and n. The multipliers are decimal. If key does
+// not exist or the value cannot be parsed the default value is returned.
+func (p *Properties) GetSIFloat(key string, def float64) float64 {
+	v, err := p.getSIFloat(key)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetSIFloat parses the expanded value as a float64 with an optional SI
+// suffix if the key exists. If key does not exist or the value cannot be
+// parsed the function panics.
+func (p *Properties) MustGetSIFloat(key string) float64 {
+	p.mustResolve()
+	v, err := p.getSIFloat(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getSIFloat(key string) (value float64, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return 0, invalidKeyError(key)
+	}
+	v = strings.TrimSpace(v)
+	exp := 0
+	if r, w := utf8.DecodeLastRuneInString(v); w > 0 {
+		if e, ok := siExponents[r]; ok {
+			exp = e
+			v = strings.TrimSpace(v[:len(v)-w])
+		}
+	}
+	value, err = strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	// divide for negative exponents to avoid rounding errors
+	if exp < 0 {
+		return value / math.Pow10(-exp), nil
+	}
+	return value * math.Pow10(exp), nil
+}
+
+// ----------------------------------------------------------------------------
+
+// weightsEpsilon is the permitted deviation of the sum of weights from 1.
+const weightsEpsilon = 1e-6
+
+// GetWeights parses the expanded value as a list of float64 weights
+// separated by sep, e.g. "0.2,0.3,0.5". The weights must not be negative
+// and must sum up to 1. If key does not exist or the value cannot be
+// parsed or is not a valid distribution the default value is returned.
+func (p *Properties) GetWeights(key, sep string, def []float64) []float64 {
+	v, err := p.getWeights(key, sep)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetWeights parses the expanded value as a list of float64 weights
+// separated by sep if the key exists. If key does not exist or the value
+// cannot be parsed or is not a valid distribution the function panics.
+func (p *Properties) MustGetWeights(key, sep string) []float64 {
+	p.mustResolve()
+	v, err := p.getWeights(key, sep)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getWeights(key, sep string) (value []float64, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return nil, invalidKeyError(key)
+	}
+	sum := 0.0
+	for _, s := range strings.Split(v, sep) {
+		w, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q for key %s: %s", s, key, err)
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight %q for key %s", s, key)
+		}
+		sum += w
+		value = append(value, w)
+	}
+	if math.Abs(sum-1) > weightsEpsilon {
+		return nil, fmt.Errorf("weights for key %s sum up to %g instead of 1", key, sum)
+	}
+	return value, nil
+}
+
 // GetInt parses the expanded value as an int if the key exists.
 // If key does not exist or the value cannot be parsed the default
 // value is returned. If the value does not fit into an int the
@@ -357,6 +992,7 @@ func (p *Properties) GetInt(key string, def int) int {
 // If the value does not fit into an int the function panics with
 // an out of range error.
 func (p *Properties) MustGetInt(key string) int {
+	p.mustResolve()
 	v, err := p.getInt64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -364,6 +1000,17 @@ func (p *Properties) MustGetInt(key string) int {
 	return intRangeCheck(key, v)
 }
 
+// GetIntE parses the expanded value as an int if the key exists.
+// If key does not exist, the value cannot be parsed or does not fit
+// into an int an error is returned.
+func (p *Properties) GetIntE(key string) (int, error) {
+	v, err := p.getInt64(key)
+	if err != nil {
+		return 0, err
+	}
+	return intRange(key, v)
+}
+
 // ----------------------------------------------------------------------------
 
 // GetInt64 parses the expanded value as an int64 if the key exists.
@@ -380,6 +1027,7 @@ func (p *Properties) GetInt64(key string, def int64) int64 {
 // MustGetInt64 parses the expanded value as an int if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetInt64(key string) int64 {
+	p.mustResolve()
 	v, err := p.getInt64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -387,6 +1035,12 @@ func (p *Properties) MustGetInt64(key string) int64 {
 	return v
 }
 
+// GetInt64E parses the expanded value as an int64 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetInt64E(key string) (int64, error) {
+	return p.getInt64(key)
+}
+
 func (p *Properties) getInt64(key string) (value int64, err error) {
 	if v, ok := p.Get(key); ok {
 		value, err = strconv.ParseInt(v, 10, 64)
@@ -400,57 +1054,162 @@ func (p *Properties) getInt64(key string) (value int64, err error) {
 
 // ----------------------------------------------------------------------------
 
-// GetInt32 parses the expanded value as an int32 if the key exists.
-// If key does not exist or the value cannot be parsed the default
+// GetIntSlice parses the expanded value as a list of ints separated by
+// sep, e.g. "80,443,8080". Whitespace around the elements is ignored.
+// If key does not exist or any element cannot be parsed the default
 // value is returned.
-func (p *Properties) GetInt32(key string, def int32) int32 {
-	v, err := p.getInt32(key)
+func (p *Properties) GetIntSlice(key, sep string, def []int) []int {
+	v, err := p.getIntSlice(key, sep)
 	if err != nil {
 		return def
 	}
 	return v
 }
 
-// MustGetInt32 parses the expanded value as an int if the key exists.
-// If key does not exist or the value cannot be parsed the function panics.
-func (p *Properties) MustGetInt32(key string) int32 {
-	v, err := p.getInt32(key)
+// MustGetIntSlice parses the expanded value as a list of ints separated
+// by sep if the key exists. If key does not exist or any element cannot
+// be parsed the function panics.
+func (p *Properties) MustGetIntSlice(key, sep string) []int {
+	p.mustResolve()
+	v, err := p.getIntSlice(key, sep)
 	if err != nil {
 		ErrorHandler(err)
 	}
 	return v
 }
 
-func (p *Properties) getInt32(key string) (value int32, err error) {
-	if v, ok := p.Get(key); ok {
-		n, err := strconv.ParseInt(v, 10, 32)
+func (p *Properties) getIntSlice(key, sep string) (value []int, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return nil, invalidKeyError(key)
+	}
+	for _, s := range strings.Split(v, sep) {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
 		if err != nil {
-			return 0, err
+			return nil, fmt.Errorf("invalid int %q for key %s: %s", s, key, err)
 		}
-		return int32(n), nil
+		value = append(value, n)
 	}
-	return 0, invalidKeyError(key)
+	return value, nil
 }
 
 // ----------------------------------------------------------------------------
 
-// GetUint parses the expanded value as an uint if the key exists.
-// If key does not exist or the value cannot be parsed the default
-// value is returned. If the value does not fit into an int the
-// function panics with an out of range error.
-func (p *Properties) GetUint(key string, def uint) uint {
-	v, err := p.getUint64(key)
+// countMultipliers maps the suffixes of counts to their decimal multipliers.
+var countMultipliers = map[byte]int64{
+	'k': 1e3, 'K': 1e3,
+	'm': 1e6, 'M': 1e6,
+	'g': 1e9, 'G': 1e9,
+}
+
+// GetCount parses the expanded value as an int64 with an optional
+// k, m or g suffix for a multiple of 1000, 1000000 or 1000000000,
+// e.g. "2k" is 2000. The suffixes are case-insensitive. If key does
+// not exist or the value cannot be parsed the default value is returned.
+func (p *Properties) GetCount(key string, def int64) int64 {
+	v, err := p.getCount(key)
 	if err != nil {
 		return def
 	}
-	return uintRangeCheck(key, v)
+	return v
 }
 
-// MustGetUint parses the expanded value as an int if the key exists.
+// MustGetCount parses the expanded value as an int64 with an optional
+// k, m or g suffix if the key exists. If key does not exist or the value
+// cannot be parsed the function panics.
+func (p *Properties) MustGetCount(key string) int64 {
+	p.mustResolve()
+	v, err := p.getCount(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getCount(key string) (value int64, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return 0, invalidKeyError(key)
+	}
+	v = strings.TrimSpace(v)
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		if m, ok := countMultipliers[v[n-1]]; ok {
+			mult = m
+			v = strings.TrimSpace(v[:n-1])
+		}
+	}
+	value, err = strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value > math.MaxInt64/mult || value < math.MinInt64/mult {
+		return 0, fmt.Errorf("value %s for key %s out of range", v, key)
+	}
+	return value * mult, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// GetInt32 parses the expanded value as an int32 if the key exists.
+// If key does not exist or the value cannot be parsed the default
+// value is returned.
+func (p *Properties) GetInt32(key string, def int32) int32 {
+	v, err := p.getInt32(key)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetInt32 parses the expanded value as an int if the key exists.
+// If key does not exist or the value cannot be parsed the function panics.
+func (p *Properties) MustGetInt32(key string) int32 {
+	p.mustResolve()
+	v, err := p.getInt32(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+// GetInt32E parses the expanded value as an int32 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetInt32E(key string) (int32, error) {
+	return p.getInt32(key)
+}
+
+func (p *Properties) getInt32(key string) (value int32, err error) {
+	if v, ok := p.Get(key); ok {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return int32(n), nil
+	}
+	return 0, invalidKeyError(key)
+}
+
+// ----------------------------------------------------------------------------
+
+// GetUint parses the expanded value as an uint if the key exists.
+// If key does not exist or the value cannot be parsed the default
+// value is returned. If the value does not fit into an int the
+// function panics with an out of range error.
+func (p *Properties) GetUint(key string, def uint) uint {
+	v, err := p.getUint64(key)
+	if err != nil {
+		return def
+	}
+	return uintRangeCheck(key, v)
+}
+
+// MustGetUint parses the expanded value as an int if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 // If the value does not fit into an int the function panics with
 // an out of range error.
 func (p *Properties) MustGetUint(key string) uint {
+	p.mustResolve()
 	v, err := p.getUint64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -458,6 +1217,17 @@ func (p *Properties) MustGetUint(key string) uint {
 	return uintRangeCheck(key, v)
 }
 
+// GetUintE parses the expanded value as an uint if the key exists.
+// If key does not exist, the value cannot be parsed or does not fit
+// into an uint an error is returned.
+func (p *Properties) GetUintE(key string) (uint, error) {
+	v, err := p.getUint64(key)
+	if err != nil {
+		return 0, err
+	}
+	return uintRange(key, v)
+}
+
 // ----------------------------------------------------------------------------
 
 // GetUint64 parses the expanded value as an uint64 if the key exists.
@@ -474,6 +1244,7 @@ func (p *Properties) GetUint64(key string, def uint64) uint64 {
 // MustGetUint64 parses the expanded value as an int if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetUint64(key string) uint64 {
+	p.mustResolve()
 	v, err := p.getUint64(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -481,6 +1252,12 @@ func (p *Properties) MustGetUint64(key string) uint64 {
 	return v
 }
 
+// GetUint64E parses the expanded value as an uint64 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetUint64E(key string) (uint64, error) {
+	return p.getUint64(key)
+}
+
 func (p *Properties) getUint64(key string) (value uint64, err error) {
 	if v, ok := p.Get(key); ok {
 		value, err = strconv.ParseUint(v, 10, 64)
@@ -508,6 +1285,7 @@ func (p *Properties) GetUint32(key string, def uint32) uint32 {
 // MustGetUint32 parses the expanded value as an int if the key exists.
 // If key does not exist or the value cannot be parsed the function panics.
 func (p *Properties) MustGetUint32(key string) uint32 {
+	p.mustResolve()
 	v, err := p.getUint32(key)
 	if err != nil {
 		ErrorHandler(err)
@@ -515,6 +1293,12 @@ func (p *Properties) MustGetUint32(key string) uint32 {
 	return v
 }
 
+// GetUint32E parses the expanded value as an uint32 if the key exists.
+// If key does not exist or the value cannot be parsed an error is returned.
+func (p *Properties) GetUint32E(key string) (uint32, error) {
+	return p.getUint32(key)
+}
+
 func (p *Properties) getUint32(key string) (value uint32, err error) {
 	if v, ok := p.Get(key); ok {
 		n, err := strconv.ParseUint(v, 10, 32)
@@ -540,6 +1324,7 @@ func (p *Properties) GetString(key, def string) string {
 // MustGetString returns the expanded value for the given key if exists or
 // panics otherwise.
 func (p *Properties) MustGetString(key string) string {
+	p.mustResolve()
 	if v, ok := p.Get(key); ok {
 		return v
 	}
@@ -547,6 +1332,440 @@ func (p *Properties) MustGetString(key string) string {
 	panic("ErrorHandler should exit")
 }
 
+// GetFirstLine returns the first line of the expanded value for the given
+// key if exists or the default value otherwise. Line breaks can be LF or
+// CRLF.
+func (p *Properties) GetFirstLine(key, def string) string {
+	v, ok := p.Get(key)
+	if !ok {
+		return def
+	}
+	if i := strings.IndexByte(v, '\n'); i >= 0 {
+		v = strings.TrimSuffix(v[:i], "\r")
+	}
+	return v
+}
+
+// ----------------------------------------------------------------------------
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// GetUUID returns the expanded value for the given key if it is a UUID of
+// the form xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx. If the key does not exist
+// or the value is not a UUID the default value is returned.
+func (p *Properties) GetUUID(key, def string) string {
+	v, err := p.getUUID(key)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetUUID returns the expanded value for the given key if it is a UUID
+// of the form xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx. If the key does not
+// exist or the value is not a UUID the function panics.
+func (p *Properties) MustGetUUID(key string) string {
+	p.mustResolve()
+	v, err := p.getUUID(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getUUID(key string) (value string, err error) {
+	if v, ok := p.Get(key); ok {
+		if !uuidRegexp.MatchString(v) {
+			return "", fmt.Errorf("invalid UUID %q for key %s", v, key)
+		}
+		return v, nil
+	}
+	return "", invalidKeyError(key)
+}
+
+// ----------------------------------------------------------------------------
+
+// GetCIDR parses the expanded value as a CIDR network like "10.0.0.0/8"
+// with net.ParseCIDR. ok is false if the key does not exist or the value
+// cannot be parsed.
+func (p *Properties) GetCIDR(key string) (network *net.IPNet, ok bool) {
+	v, err := p.getCIDR(key)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// MustGetCIDR parses the expanded value as a CIDR network like "10.0.0.0/8"
+// with net.ParseCIDR. If the key does not exist or the value cannot be
+// parsed the function panics.
+func (p *Properties) MustGetCIDR(key string) *net.IPNet {
+	p.mustResolve()
+	v, err := p.getCIDR(key)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+// GetCIDRList parses the expanded value as a comma separated list of CIDR
+// networks like "10.0.0.0/8, 192.168.0.0/16". ok is false if the key does
+// not exist or one of the networks cannot be parsed.
+func (p *Properties) GetCIDRList(key string) (networks []*net.IPNet, ok bool) {
+	v, ok := p.Get(key)
+	if !ok {
+		return nil, false
+	}
+	for _, s := range strings.Split(v, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, false
+		}
+		networks = append(networks, network)
+	}
+	return networks, true
+}
+
+func (p *Properties) getCIDR(key string) (value *net.IPNet, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return nil, invalidKeyError(key)
+	}
+	_, value, err = net.ParseCIDR(strings.TrimSpace(v))
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// GetStringEnv returns the expanded value for the given key if exists.
+// Otherwise, it returns the value of the environment variable envVar if
+// it is not empty or the default value. The environment variable is read
+// with os.Getenv and is not expanded.
+func (p *Properties) GetStringEnv(key, envVar, def string) string {
+	if v, ok := p.Get(key); ok {
+		return v
+	}
+	if v := os.Getenv(envVar); v != "" {
+		return v
+	}
+	return def
+}
+
+// MustGetStringEnv returns the expanded value for the given key if exists.
+// Otherwise, it returns the value of the environment variable envVar if
+// it is not empty or panics.
+func (p *Properties) MustGetStringEnv(key, envVar string) string {
+	p.mustResolve()
+	if v, ok := p.Get(key); ok {
+		return v
+	}
+	if v := os.Getenv(envVar); v != "" {
+		return v
+	}
+	ErrorHandler(fmt.Errorf("unknown property: %s and environment variable %s is not set", key, envVar))
+	panic("ErrorHandler should exit")
+}
+
+// ----------------------------------------------------------------------------
+
+// GetTemplate executes the expanded value for the given key as a
+// text/template. The data of the template is a map of all expanded
+// values and the values of extra which take precedence. Keys which are
+// not valid identifiers can be accessed with the index function, e.g.
+// {{index . "db.host"}}. An error is returned if the key does not exist
+// or the template cannot be parsed or executed.
+func (p *Properties) GetTemplate(key string, extra map[string]interface{}) (string, error) {
+	p.resolve()
+	v, ok := p.Get(key)
+	if !ok {
+		return "", invalidKeyError(key)
+	}
+	t, err := template.New(key).Option("missingkey=error").Parse(v)
+	if err != nil {
+		return "", err
+	}
+
+	data := make(map[string]interface{}, len(p.k)+len(extra))
+	for _, k := range p.k {
+		data[p.name(k)], _ = p.get(k)
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// ----------------------------------------------------------------------------
+
+// GetMany returns the expanded values for all given keys which exist.
+// Keys which do not exist are omitted.
+func (p *Properties) GetMany(keys ...string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if v, ok := p.get(k); ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// MustGetMany returns the expanded values for all given keys.
+// If one of the keys does not exist the function panics.
+func (p *Properties) MustGetMany(keys ...string) map[string]string {
+	p.mustResolve()
+	m := p.GetMany(keys...)
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			ErrorHandler(invalidKeyError(k))
+		}
+	}
+	return m
+}
+
+// ----------------------------------------------------------------------------
+
+// RequireAll returns an error which lists all keys which do not exist.
+// The values are not expanded.
+func (p *Properties) RequireAll(keys ...string) error {
+	p.resolve()
+	var missing []string
+	for _, k := range keys {
+		if _, ok := p.m[p.normKey(k)]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing properties: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+// GetMapped looks up the expanded value in the mapping m if the key exists
+// and returns the mapped value. An exact match is preferred, otherwise the
+// comparison is case-insensitive. If the key does not exist or the value is not in the mapping the default value
+// is returned.
+func (p *Properties) GetMapped(key string, m map[string]int, def int) int {
+	v, err := p.getMapped(key, m)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// MustGetMapped looks up the expanded value in the mapping m if the key
+// exists and returns the mapped value. An exact match is preferred,
+// otherwise the comparison is case-insensitive. If the key does not exist
+// or the value is not in the mapping the function panics.
+func (p *Properties) MustGetMapped(key string, m map[string]int) int {
+	p.mustResolve()
+	v, err := p.getMapped(key, m)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return v
+}
+
+func (p *Properties) getMapped(key string, m map[string]int) (value int, err error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return 0, invalidKeyError(key)
+	}
+	if n, ok := m[v]; ok {
+		return n, nil
+	}
+	// fall back to the smallest case-insensitive match so that the
+	// result does not depend on the map iteration order.
+	match, found := "", false
+	for s := range m {
+		if strings.EqualFold(s, v) && (!found || s < match) {
+			match, found = s, true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("unmapped value %q for key %s", v, key)
+	}
+	return m[match], nil
+}
+
+// ----------------------------------------------------------------------------
+
+// GetOneOf returns the expanded value for the given key if it is one of the
+// options. The comparison is case-sensitive. If the key does not exist or
+// the value is not one of the options an error is returned.
+func (p *Properties) GetOneOf(key string, options []string) (string, error) {
+	v, ok := p.Get(key)
+	if !ok {
+		return "", invalidKeyError(key)
+	}
+	for _, o := range options {
+		if v == o {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value %q for key %s. must be one of [%s]", v, key, strings.Join(options, ", "))
+}
+
+// ----------------------------------------------------------------------------
+
+// byteSizeRegexp matches byte sizes like "512B", "10MB" or "1.5 GiB".
+var byteSizeRegexp = regexp.MustCompile(`^(?i)[0-9]+(\.[0-9]+)?\s*[kmgtpe]?i?b$`)
+
+// Classify returns the kind of the expanded value for the given key which
+// is the first of the following which the value can be parsed as:
+//
+//	"int"      a decimal integer, e.g. "10" or "-1"
+//	"float"    a finite floating point number, e.g. "3.14" or "1e3"
+//	"bool"     one of true, false, yes, no, on or off in any case
+//	"duration" a time.Duration, e.g. "10s" or "1h30m"
+//	"bytes"    a byte size, e.g. "512B", "10MB" or "1.5GiB"
+//	"string"   any other value
+//
+// If the key does not exist ok is false.
+func (p *Properties) Classify(key string) (kind string, ok bool) {
+	v, ok := p.Get(key)
+	if !ok {
+		return "", false
+	}
+	return classify(v), true
+}
+
+// classify returns the kind of v as described for Classify.
+func classify(v string) string {
+	if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return "int"
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return "float"
+	}
+	switch strings.ToLower(v) {
+	case "true", "false", "yes", "no", "on", "off":
+		return "bool"
+	}
+	if _, err := time.ParseDuration(v); err == nil {
+		return "duration"
+	}
+	if byteSizeRegexp.MatchString(v) {
+		return "bytes"
+	}
+	return "string"
+}
+
+// GetTypedSlice returns the expanded value for the given key split by
+// sep with the elements converted to int, float64 or bool if Classify
+// would classify them as such. All other elements are returned as
+// string. The elements are trimmed of whitespace and empty elements are
+// omitted. If the key does not exist nil is returned.
+func (p *Properties) GetTypedSlice(key, sep string) []interface{} {
+	v, ok := p.Get(key)
+	if !ok {
+		return nil
+	}
+	var values []interface{}
+	for _, s := range split(v, sep) {
+		switch classify(s) {
+		case "int":
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err == nil && int64(int(n)) == n {
+				values = append(values, int(n))
+				continue
+			}
+			values = append(values, s)
+		case "float":
+			f, _ := strconv.ParseFloat(s, 64)
+			values = append(values, f)
+		case "bool":
+			values = append(values, boolVal(s))
+		default:
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// ----------------------------------------------------------------------------
+
+// GetSliceMap returns the expanded values of all keys with the given
+// prefix split by sep. The map keys are the keys with the prefix removed.
+// The elements are trimmed of whitespace and empty elements are omitted.
+// For example, the prefix "routes." maps 'routes.public = /a, /b' to
+// "public": ["/a", "/b"].
+func (p *Properties) GetSliceMap(prefix, sep string) map[string][]string {
+	m := map[string][]string{}
+	for _, k := range p.FilterStripPrefix(prefix).Keys() {
+		v, _ := p.get(prefix + k)
+		m[k] = split(v, sep)
+	}
+	return m
+}
+
+// ----------------------------------------------------------------------------
+
+// GetConcat returns the concatenation of the expanded values of all keys
+// of the form prefix + number, e.g. "msg.1", "msg.2", ..., in numeric order.
+// Keys with a non-numeric suffix are skipped as are gaps in the numbering.
+// Numbers with a sign or leading zeros like "+1" or "01" are treated as
+// non-numeric so that every number has only one key.
+func (p *Properties) GetConcat(prefix string) string {
+	s, _ := p.getConcat(prefix)
+	return s
+}
+
+// MustGetConcat returns the concatenation of the expanded values of all keys
+// of the form prefix + number in numeric order. If a key under the prefix
+// has a non-numeric suffix or there is a gap in the numbering the function
+// panics.
+func (p *Properties) MustGetConcat(prefix string) string {
+	p.mustResolve()
+	s, err := p.getConcat(prefix)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return s
+}
+
+func (p *Properties) getConcat(prefix string) (value string, err error) {
+	p.resolve()
+	idx := map[int]string{}
+	var nums []int
+	for _, k := range p.k {
+		suffix, ok := p.cutPrefix(k, prefix)
+		if !ok || suffix == "" {
+			continue
+		}
+		// only the canonical form is accepted so that the numbers are unique
+		n, perr := strconv.Atoi(suffix)
+		if perr != nil || n < 0 || strconv.Itoa(n) != suffix {
+			if err == nil {
+				err = fmt.Errorf("non-numeric suffix in key %s", p.name(k))
+			}
+			continue
+		}
+		idx[n] = k
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	var b strings.Builder
+	for i, n := range nums {
+		if i > 0 && n != nums[i-1]+1 && err == nil {
+			err = fmt.Errorf("missing key %s%d", prefix, nums[i-1]+1)
+		}
+		v, _ := p.get(idx[n])
+		b.WriteString(v)
+	}
+	return b.String(), err
+}
+
 // ----------------------------------------------------------------------------
 
 // Filter returns a new properties object which contains all properties
@@ -563,256 +1782,1482 @@ func (p *Properties) Filter(pattern string) (*Properties, error) {
 // FilterRegexp returns a new properties object which contains all properties
 // for which the key matches the regular expression.
 func (p *Properties) FilterRegexp(re *regexp.Regexp) *Properties {
-	pp := NewProperties()
+	p.resolve()
+	pp := p.newFiltered()
 	for _, k := range p.k {
-		if re.MatchString(k) {
+		if re.MatchString(p.name(k)) {
 			// TODO(fs): we are ignoring the error which flags a circular reference.
 			// TODO(fs): since we are just copying a subset of keys this cannot happen (fingers crossed)
-			pp.Set(k, p.m[k])
+			pp.set(p.name(k), p.m[k])
+		}
+	}
+	return pp
+}
+
+// Entry is a key/value pair.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// EntriesMatching returns the keys which match the regular expression
+// mapped to their expanded values.
+func (p *Properties) EntriesMatching(expr string) (map[string]string, error) {
+	entries, err := p.EntriesMatchingOrdered(expr)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(entries))
+	for _, e := range entries {
+		m[e.Key] = e.Value
+	}
+	return m, nil
+}
+
+// EntriesMatchingOrdered returns the keys which match the regular
+// expression with their expanded values in the order of the keys.
+func (p *Properties) EntriesMatchingOrdered(expr string) ([]Entry, error) {
+	p.resolve()
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, k := range p.k {
+		if re.MatchString(p.name(k)) {
+			v, _ := p.get(k)
+			entries = append(entries, Entry{p.name(k), v})
+		}
+	}
+	return entries, nil
+}
+
+// FilterPrefix returns a new properties object with a subset of all keys
+// with the given prefix.
+func (p *Properties) FilterPrefix(prefix string) *Properties {
+	p.resolve()
+	pp := p.newFiltered()
+	for _, k := range p.k {
+		if _, ok := p.cutPrefix(k, prefix); ok {
+			// TODO(fs): we are ignoring the error which flags a circular reference.
+			// TODO(fs): since we are just copying a subset of keys this cannot happen (fingers crossed)
+			pp.set(p.name(k), p.m[k])
+		}
+	}
+	return pp
+}
+
+// FilterStripPrefix returns a new properties object with a subset of all keys
+// with the given prefix and the prefix removed from the keys.
+func (p *Properties) FilterStripPrefix(prefix string) *Properties {
+	p.resolve()
+	pp := p.newFiltered()
+	for _, k := range p.k {
+		if name, ok := p.cutPrefix(k, prefix); ok && name != "" {
+			// TODO(fs): we are ignoring the error which flags a circular reference.
+			// TODO(fs): since we are modifying keys I am not entirely sure whether we can create a circular reference
+			// TODO(fs): this function should probably return an error but the signature is fixed
+			pp.set(name, p.m[k])
+		}
+	}
+	return pp
+}
+
+// Len returns the number of keys.
+func (p *Properties) Len() int {
+	p.resolve()
+	return len(p.m)
+}
+
+// Keys returns all keys in the same order as in the input.
+func (p *Properties) Keys() []string {
+	p.resolve()
+	keys := make([]string, len(p.k))
+	for i, k := range p.k {
+		keys[i] = p.name(k)
+	}
+	return keys
+}
+
+// KeysPage returns at most limit keys starting at offset in the same order
+// as in the input and the total number of keys. An offset past the end or
+// a limit which is not positive returns no keys.
+func (p *Properties) KeysPage(offset, limit int) (keys []string, total int) {
+	p.resolve()
+	total = len(p.k)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= total || limit <= 0 {
+		return []string{}, total
+	}
+	end := total
+	if limit < total-offset {
+		end = offset + limit
+	}
+	keys = make([]string, 0, end-offset)
+	for _, k := range p.k[offset:end] {
+		keys = append(keys, p.name(k))
+	}
+	return keys, total
+}
+
+// Set sets the property key to the corresponding value.
+// If a value for key existed before then ok is true and prev
+// contains the previous value. If the value contains a
+// circular reference, a malformed expression or the key or
+// value contain a malformed unicode literal like '\u12' then
+// an error is returned. A '\u' which is not followed by a hex
+// digit like in 'C:\users' is not a unicode literal.
+// If a validator has been set with
+// SetValidator and it rejects the entry then its error is
+// returned.
+// An empty key is silently ignored.
+func (p *Properties) Set(key, value string) (prev string, ok bool, err error) {
+	if key == "" {
+		return "", false, nil
+	}
+	if err := checkUnicodeLiterals(key); err != nil {
+		return "", false, err
+	}
+	if err := checkUnicodeLiterals(value); err != nil {
+		return "", false, err
+	}
+	return p.set(key, value)
+}
+
+// set sets the property key to the value like Set without checking
+// for malformed unicode literals. It is used to copy values which are
+// already stored.
+func (p *Properties) set(key, value string) (prev string, ok bool, err error) {
+	p.resolve()
+	if key == "" {
+		return "", false, nil
+	}
+	if p.validator != nil {
+		if err := p.validator(key, value); err != nil {
+			return "", false, err
+		}
+	}
+	name := key
+	key = p.normKey(key)
+
+	// if expansion is disabled we allow circular references
+	if p.DisableExpansion {
+		prev, ok = p.get(key)
+		p.m[key] = value
+		if !ok {
+			p.k = append(p.k, key)
+			p.setName(key, name)
+		}
+		delete(p.sources, key)
+		p.dirty = true
+		p.invalidate()
+		return prev, ok, nil
+	}
+
+	// to check for a circular reference we temporarily need
+	// to set the new value. If there is an error then revert
+	// to the previous state. Only if all tests are successful
+	// then we add the key to the p.k list.
+	prev, ok = p.get(key)
+	p.m[key] = value
+
+	// now check for a circular reference
+	_, err = p.expand(key, value)
+	if err != nil {
+
+		// revert to the previous state
+		if ok {
+			p.m[key] = prev
+		} else {
+			delete(p.m, key)
+		}
+
+		return "", false, err
+	}
+
+	if !ok {
+		p.k = append(p.k, key)
+		p.setName(key, name)
+	}
+	delete(p.sources, key)
+	p.dirty = true
+	p.invalidate()
+
+	return prev, ok, nil
+}
+
+// OverrideFromMap sets all keys of m to their values in alphabetical order
+// of the keys. It stops at the first error and returns it. The keys which
+// were set before the error keep their new values.
+func (p *Properties) OverrideFromMap(m map[string]string) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, _, err := p.Set(k, m[k]); err != nil {
+			return fmt.Errorf("properties: cannot set %s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// OverrideFromMapAtomic sets all keys of m to their values. If one of the
+// values cannot be set the properties remain unchanged and the error is
+// returned.
+func (p *Properties) OverrideFromMapAtomic(m map[string]string) error {
+	pp := p.clone()
+	if err := pp.OverrideFromMap(m); err != nil {
+		return err
+	}
+	*p = *pp
+	return nil
+}
+
+// SetValue sets property key to the default string value
+// as defined by fmt.Sprintf("%v").
+func (p *Properties) SetValue(key string, value interface{}) error {
+	_, _, err := p.Set(key, fmt.Sprintf("%v", value))
+	return err
+}
+
+// SetValidator sets a function which Set calls with the key and the
+// unexpanded value of every entry before it is stored. If fn returns an
+// error the entry is rejected and Set returns the error. Existing
+// entries are not validated. Use Validate to check them. A nil fn
+// removes the validator.
+func (p *Properties) SetValidator(fn func(key, value string) error) {
+	p.validator = fn
+}
+
+// Validate calls the validator set with SetValidator for all entries
+// with their unexpanded values in order and returns the first error.
+func (p *Properties) Validate() error {
+	p.resolve()
+	if p.validator == nil {
+		return nil
+	}
+	for _, k := range p.k {
+		if err := p.validator(p.name(k), p.m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustSet sets the property key to the corresponding value.
+// If a value for key existed before then ok is true and prev
+// contains the previous value. An empty key is silently ignored.
+func (p *Properties) MustSet(key, value string) (prev string, ok bool) {
+	p.mustResolve()
+	prev, ok, err := p.Set(key, value)
+	if err != nil {
+		ErrorHandler(err)
+	}
+	return prev, ok
+}
+
+// CompareAndSwap sets the key to the value new only if the key exists and
+// its unexpanded value is equal to old. swapped is true if the value was
+// set. If new contains a circular reference or a malformed expression the
+// value is not set and the error is returned.
+//
+// CompareAndSwap is a conditional Set which detects changes of the value
+// since old was read, e.g. by Reload or Merge. It does not synchronize
+// access. Like all other methods it is not safe for concurrent use and
+// callers which share the properties between goroutines must guard all
+// calls with their own lock.
+func (p *Properties) CompareAndSwap(key, old, new string) (swapped bool, err error) {
+	p.resolve()
+	if v, ok := p.m[p.normKey(key)]; !ok || v != old {
+		return false, nil
+	}
+	if _, _, err := p.Set(key, new); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// String returns a string of all expanded 'key = value' pairs.
+func (p *Properties) String() string {
+	p.resolve()
+	var s string
+	for _, key := range p.k {
+		value, _ := p.get(key)
+		s = fmt.Sprintf("%s%s = %s\n", s, p.name(key), value)
+	}
+	return s
+}
+
+// Sort sorts the properties keys in alphabetical order.
+// This is helpfully before writing the properties.
+func (p *Properties) Sort() {
+	p.resolve()
+	sort.Strings(p.k)
+	p.dirty = true
+}
+
+// Sorted returns a copy of the properties with the keys sorted in
+// alphabetical order. Values, comments and settings are preserved.
+func (p *Properties) Sorted() *Properties {
+	p.resolve()
+	pp := p.clone()
+	sort.Strings(pp.k)
+	pp.dirty = true
+	return pp
+}
+
+// Redacted returns a copy of the properties where the values of all keys
+// for which keyMatch returns true are replaced with "***". Values which
+// refer to these keys are therefore masked when expanded as well.
+func (p *Properties) Redacted(keyMatch func(key string) bool) *Properties {
+	p.resolve()
+	pp := p.clone()
+	for _, k := range pp.k {
+		if keyMatch(pp.name(k)) {
+			pp.m[k] = "***"
+			pp.dirty = true
+		}
+	}
+	return pp
+}
+
+// Intersect returns a copy of the properties which contains only the keys
+// which also exist in other. Values, comments and order of the keys are
+// taken from p.
+func (p *Properties) Intersect(other *Properties) *Properties {
+	p.resolve()
+	pp := p.clone()
+	for _, k := range p.k {
+		if _, ok := other.m[other.normKey(p.name(k))]; !ok {
+			pp.Delete(k)
+		}
+	}
+	return pp
+}
+
+// RenameAll renames the keys of the mapping to their new names. The keys
+// keep their position, values and comments. An error is returned and the
+// properties remain unchanged if a key does not exist, a new name already
+// exists and is not renamed itself or is the target of more than one
+// rename, or the renames introduce a circular reference.
+func (p *Properties) RenameAll(mapping map[string]string) error {
+	p.resolve()
+	olds := make([]string, 0, len(mapping))
+	for k := range mapping {
+		olds = append(olds, k)
+	}
+	sort.Strings(olds)
+
+	renames := make(map[string]string, len(mapping))
+	targets := map[string]string{}
+	for _, old := range olds {
+		k, name := p.normKey(old), mapping[old]
+		if _, ok := p.m[k]; !ok {
+			return invalidKeyError(old)
+		}
+		if name == "" {
+			return fmt.Errorf("properties: cannot rename %s to an empty key", old)
+		}
+		nk := p.normKey(name)
+		if prev, ok := targets[nk]; ok {
+			return fmt.Errorf("properties: cannot rename %s and %s to %s", prev, old, name)
+		}
+		targets[nk] = old
+		renames[k] = nk
+	}
+	for nk, old := range targets {
+		if _, ok := p.m[nk]; !ok {
+			continue
+		}
+		if _, ok := renames[nk]; !ok {
+			return fmt.Errorf("properties: cannot rename %s to %s: key exists", old, mapping[old])
+		}
+	}
+
+	pp := p.clone()
+	for k := range renames {
+		delete(pp.m, k)
+		delete(pp.c, k)
+		delete(pp.cc, k)
+		delete(pp.names, k)
+		delete(pp.sources, k)
+		delete(pp.encodings, k)
+		delete(pp.rawTexts, k)
+	}
+	for k, nk := range renames {
+		pp.m[nk] = p.m[k]
+		if c, ok := p.c[k]; ok {
+			pp.c[nk] = c
+		}
+		if cc, ok := p.cc[k]; ok {
+			pp.setCommentChars(nk, cc)
+		}
+		if src, ok := p.sources[k]; ok {
+			pp.sources[nk] = src
+		}
+		if enc, ok := p.encodings[k]; ok {
+			pp.encodings[nk] = enc
+		}
+		if raw, ok := p.rawTexts[k]; ok {
+			pp.setRawText(nk, raw.text, raw.value)
+		}
+		pp.setName(nk, mapping[targets[nk]])
+	}
+	for i, k := range pp.k {
+		if nk, ok := renames[k]; ok {
+			pp.k[i] = nk
+		}
+	}
+	if !pp.DisableExpansion {
+		if err := pp.check(); err != nil {
+			return err
+		}
+	}
+	pp.dirty = true
+	*p = *pp
+	return nil
+}
+
+// clone returns a deep copy of the properties.
+func (p *Properties) clone() *Properties {
+	p.resolve()
+	pp := *p
+	if p.cache != nil {
+		pp.cache = &expansionCache{}
+	}
+	pp.m = make(map[string]string, len(p.m))
+	for k, v := range p.m {
+		pp.m[k] = v
+	}
+	pp.c = make(map[string][]string, len(p.c))
+	for k, v := range p.c {
+		pp.c[k] = append([]string(nil), v...)
+	}
+	pp.cc = nil
+	for k, v := range p.cc {
+		pp.setCommentChars(k, append([]string(nil), v...))
+	}
+	pp.trailingComments = append([]string(nil), p.trailingComments...)
+	pp.trailingCommentChars = append([]string(nil), p.trailingCommentChars...)
+	pp.k = append([]string{}, p.k...)
+	pp.names = nil
+	for k, v := range p.names {
+		pp.setName(k, v)
+	}
+	pp.deprecated = nil
+	for k, v := range p.deprecated {
+		if pp.deprecated == nil {
+			pp.deprecated = map[string]string{}
+		}
+		pp.deprecated[k] = v
+	}
+	pp.rawTexts = nil
+	for k, v := range p.rawTexts {
+		pp.setRawText(k, v.text, v.value)
+	}
+	trackMu.Lock()
+	pp.accessed = nil
+	for k := range p.accessed {
+		if pp.accessed == nil {
+			pp.accessed = map[string]bool{}
+		}
+		pp.accessed[k] = true
+	}
+	pp.warned = nil
+	for k, v := range p.warned {
+		if pp.warned == nil {
+			pp.warned = map[string]bool{}
+		}
+		pp.warned[k] = v
+	}
+	trackMu.Unlock()
+	pp.encodings = nil
+	for k, v := range p.encodings {
+		if pp.encodings == nil {
+			pp.encodings = map[string]Encoding{}
+		}
+		pp.encodings[k] = v
+	}
+	pp.sources = nil
+	for k, v := range p.sources {
+		if pp.sources == nil {
+			pp.sources = map[string]string{}
+		}
+		pp.sources[k] = v
+	}
+	pp.watchers = nil
+	for k, v := range p.watchers {
+		if pp.watchers == nil {
+			pp.watchers = map[string][]func(old, new string){}
+		}
+		pp.watchers[k] = append(([]func(old, new string))(nil), v...)
+	}
+	return &pp
+}
+
+// Bytes returns the properties in their serialized form. If the properties
+// were loaded with PreserveFormatting and have not been modified since then
+// Bytes returns a copy of the original input. Otherwise, the properties are
+// written with Write in the encoding of the input or UTF-8. If WriteSeparator
+// is invalid the error is passed to the ErrorHandler.
+func (p *Properties) Bytes() []byte {
+	p.resolve()
+	if p.raw != nil && !p.dirty {
+		return append([]byte(nil), p.raw...)
+	}
+	enc := p.rawEnc
+	if enc == utf8Default {
+		enc = UTF8
+	}
+	var buf bytes.Buffer
+	if _, err := p.Write(&buf, enc); err != nil {
+		ErrorHandler(err)
+	}
+	return buf.Bytes()
+}
+
+// Dirty returns true if the properties were modified after they were loaded.
+func (p *Properties) Dirty() bool {
+	return p.dirty
+}
+
+// Write writes all unexpanded 'key = value' pairs to the given writer.
+// Comments are only written if PreserveFormatting is set, e.g. by a loader
+// with PreserveFormatting, since Write has always written the pairs only.
+// Use WriteComment to write the comments of other properties.
+// Write returns the number of bytes written and any write error encountered.
+func (p *Properties) Write(w io.Writer, enc Encoding) (n int, err error) {
+	return p.WriteComment(w, "", enc)
+}
+
+// WriteSorted writes all unexpanded 'key = value' pairs like Write but
+// with the keys in alphabetical order. The order of the keys in p is
+// not changed.
+func (p *Properties) WriteSorted(w io.Writer, enc Encoding) (n int, err error) {
+	return p.Sorted().Write(w, enc)
+}
+
+// WriteComment writes all unexpanced 'key = value' pairs to the given writer.
+// If prefix is not empty then comments are written with a blank line and the
+// given prefix. The prefix should be either "# " or "! " to be compatible with
+// the properties file format. Otherwise, the properties parser will not be
+// able to read the file back in. If PreserveFormatting is set then comments
+// are always written and with their original comment character. Comments
+// after the last key are written at the end, separated by an empty line
+// only if there was one in the input. It returns the number of bytes
+// written and any write error encountered.
+func (p *Properties) WriteComment(w io.Writer, prefix string, enc Encoding) (n int, err error) {
+	p.resolve()
+	var x int
+
+	if err := checkSeparator(p.WriteSeparator, p.Delimiter); err != nil {
+		return 0, err
+	}
+	nl := p.newline()
+
+	width := 0
+	if p.AlignValues {
+		for _, key := range p.k {
+			if p.isDescription(key) {
+				continue
+			}
+			if l := utf8.RuneCountInString(p.encodeKey(p.name(key), p.entryEncoding(key, enc))); l > width {
+				width = l
+			}
+		}
+	}
+
+	for _, key := range p.k {
+		if p.isDescription(key) {
+			continue
+		}
+		value := p.m[key]
+		kenc := p.entryEncoding(key, enc)
+
+		lines := p.commentLines(p.c[key], p.cc[key], prefix)
+		if desc, ok := p.description(key); ok {
+			dp := prefix
+			if dp == "" {
+				dp = "# "
+			}
+			for _, line := range strings.Split(desc, "\n") {
+				lines = append(lines, dp+line)
+			}
+		}
+
+		x, err = writeCommentLines(w, lines, n > 0, nl)
+		n += x
+		if err != nil {
+			return
+		}
+		sep := " = "
+		if p.WriteSeparator != "" {
+			sep = p.WriteSeparator
+		}
+		k := p.encodeKey(p.name(key), kenc)
+		if pad := width - utf8.RuneCountInString(k); pad > 0 {
+			k += strings.Repeat(" ", pad)
+		}
+		x, err = fmt.Fprintf(w, "%s%s%s%s", k, sep, p.encodeValue(value, kenc), nl)
+		if err != nil {
+			return
+		}
+		n += x
+	}
+
+	lines := p.commentLines(p.trailingComments, p.trailingCommentChars, prefix)
+	x, err = writeCommentLines(w, lines, n > 0 && p.trailingBlank, nl)
+	n += x
+	return
+}
+
+// commentLines returns the comments with their prefix for writing or nil
+// if the comments are not written. chars are the original comment
+// characters of the comments.
+func (p *Properties) commentLines(comments, chars []string, prefix string) []string {
+	if prefix == "" && !p.PreserveFormatting {
+		return nil
+	}
+
+	// don't print comments if they are all empty
+	allEmpty := true
+	for _, c := range comments {
+		if c != "" {
+			allEmpty = false
+			break
+		}
+	}
+	if allEmpty {
+		return nil
+	}
+
+	lines := make([]string, len(comments))
+	for i, c := range comments {
+		lines[i] = p.commentPrefix(chars, i, prefix) + c
+	}
+	return lines
+}
+
+// writeCommentLines writes the comment lines each followed by nl. If
+// blank is true and there are lines they are preceded by a blank line.
+func writeCommentLines(w io.Writer, lines []string, blank bool, nl string) (n int, err error) {
+	if len(lines) == 0 {
+		return 0, nil
+	}
+	var x int
+	if blank {
+		x, err = io.WriteString(w, nl)
+		n += x
+		if err != nil {
+			return
+		}
+	}
+	for _, line := range lines {
+		x, err = fmt.Fprintf(w, "%s%s", line, nl)
+		n += x
+		if err != nil {
+			return
 		}
 	}
-	return pp
+	return
+}
+
+// checkSeparator returns an error if the separator sep would not be
+// read as delimiter between key and value. delim is the additional
+// delimiter of the loader or empty.
+func checkSeparator(sep, delim string) error {
+	switch s := strings.Trim(sep, whitespace); {
+	case s == "", s == "=", s == ":":
+		return nil
+	case delim != "" && s == delim:
+		return nil
+	}
+	return fmt.Errorf("properties: invalid separator %q", sep)
+}
+
+// SetEncoding sets the encoding which Write and WriteComment use for the
+// given key and its value instead of the encoding passed to them. With
+// ISO_8859_1 characters outside of ISO-8859-1 are escaped as unicode
+// literals and with UTF8 they are written as is. This allows writing
+// entries which were merged from sources with different encodings.
+func (p *Properties) SetEncoding(key string, enc Encoding) {
+	p.resolve()
+	if enc == utf8Default {
+		enc = UTF8
+	}
+	if p.encodings == nil {
+		p.encodings = map[string]Encoding{}
+	}
+	p.encodings[p.normKey(key)] = enc
+	p.dirty = true
+}
+
+// entryEncoding returns the encoding for writing key which is either
+// the encoding set with SetEncoding or enc.
+func (p *Properties) entryEncoding(key string, enc Encoding) Encoding {
+	if e, ok := p.encodings[key]; ok {
+		return e
+	}
+	return enc
+}
+
+// description returns the unexpanded value of the description key
+// for key if DescriptionSuffix is set.
+func (p *Properties) description(key string) (string, bool) {
+	if p.DescriptionSuffix == "" {
+		return "", false
+	}
+	desc, ok := p.m[p.normKey(p.name(key)+p.DescriptionSuffix)]
+	return desc, ok
+}
+
+// isDescription returns true if key is the description key of another key.
+func (p *Properties) isDescription(key string) bool {
+	if p.DescriptionSuffix == "" {
+		return false
+	}
+	name := p.name(key)
+	if !strings.HasSuffix(name, p.DescriptionSuffix) {
+		return false
+	}
+	_, ok := p.m[p.normKey(strings.TrimSuffix(name, p.DescriptionSuffix))]
+	return ok
+}
+
+// encodeKey encodes a key for writing. All whitespace and delimiter
+// characters are escaped as well as a leading comment character.
+func (p *Properties) encodeKey(key string, enc Encoding) string {
+	s := p.encode(key, " :=", enc)
+	if strings.HasPrefix(s, "#") || strings.HasPrefix(s, "!") {
+		s = "\\" + s
+	}
+	return s
+}
+
+// encodeValue encodes a value for writing. If MultilineValues is set then
+// every newline is followed by a continuation line.
+func (p *Properties) encodeValue(value string, enc Encoding) string {
+	if !p.MultilineValues || !strings.Contains(value, "\n") {
+		return p.encode(value, "", enc)
+	}
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		line = p.encode(line, "", enc)
+		// leading whitespace of a continuation line is dropped on load
+		if i > 0 && strings.HasPrefix(line, " ") {
+			line = "\\" + line
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\\n\\"+p.newline()+"    ")
+}
+
+// newline returns the line separator for writing.
+func (p *Properties) newline() string {
+	if p.Newline == "" {
+		return "\n"
+	}
+	return p.Newline
+}
+
+// Map returns a copy of the properties as a map.
+func (p *Properties) Map() map[string]string {
+	p.resolve()
+	m := make(map[string]string)
+	for k, v := range p.m {
+		m[p.name(k)] = v
+	}
+	return m
+}
+
+// MarshalJSONWithMeta returns the properties as a JSON object which maps
+// every key in order to an object with the expanded value and the comments
+// of the key joined by newlines, e.g.
+//
+//	{"key":{"value":"v","comment":"c"}}
+//
+// The comment is omitted for keys without comments.
+func (p *Properties) MarshalJSONWithMeta() ([]byte, error) {
+	p.resolve()
+	type meta struct {
+		Value   string `json:"value"`
+		Comment string `json:"comment,omitempty"`
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range p.k {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(p.name(k))
+		if err != nil {
+			return nil, err
+		}
+		v, _ := p.get(k)
+		val, err := json.Marshal(meta{v, strings.Join(p.c[k], "\n")})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// AsEnviron returns the expanded key/value pairs as "KEY=value" strings
+// in the order of the keys which can be used as environment of a command,
+// e.g. for exec.Cmd.Env. The keys are converted to upper case with dots
+// replaced by underscores and are prefixed with prefix. An underscore is
+// added to a non-empty prefix if it does not end with one, e.g. the key
+// "db.host" with the prefix "APP" becomes "APP_DB_HOST".
+func (p *Properties) AsEnviron(prefix string) []string {
+	p.resolve()
+	if prefix != "" && !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+	env := make([]string, 0, len(p.k))
+	for _, k := range p.k {
+		v, _ := p.get(k)
+		name := strings.ToUpper(strings.ReplaceAll(p.name(k), ".", "_"))
+		env = append(env, prefix+name+"="+v)
+	}
+	return env
+}
+
+// ToQuery returns the expanded key/value pairs as an URL encoded query
+// string in the form "key1=value1&key2=value2" in the order of the keys.
+func (p *Properties) ToQuery() string {
+	p.resolve()
+	var b strings.Builder
+	for i, k := range p.k {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		v, _ := p.get(k)
+		b.WriteString(url.QueryEscape(p.name(k)))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(v))
+	}
+	return b.String()
+}
+
+// FilterFunc returns a copy of the properties which includes the values which passed all filters.
+func (p *Properties) FilterFunc(filters ...func(k, v string) bool) *Properties {
+	p.resolve()
+	pp := p.newFiltered()
+outer:
+	for k, v := range p.m {
+		for _, f := range filters {
+			if !f(p.name(k), v) {
+				continue outer
+			}
+			pp.set(p.name(k), v)
+		}
+	}
+	return pp
+}
+
+// ForEachPrefix calls f for all keys with the given prefix and their
+// expanded values in the order of the keys until f returns false. Unlike
+// FilterPrefix it does not create a copy of the properties.
+func (p *Properties) ForEachPrefix(prefix string, f func(key, value string) bool) {
+	p.resolve()
+	for _, k := range p.k {
+		if _, ok := p.cutPrefix(k, prefix); !ok {
+			continue
+		}
+		v, _ := p.get(k)
+		if !f(p.name(k), v) {
+			return
+		}
+	}
+}
+
+// CountPrefix returns the number of keys with the given prefix.
+func (p *Properties) CountPrefix(prefix string) int {
+	p.resolve()
+	n := 0
+	for _, k := range p.k {
+		if _, ok := p.cutPrefix(k, prefix); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// SumInt returns the sum of the expanded values of all keys with the given
+// prefix parsed as int64. An error is returned if one of the values is not
+// an integer.
+func (p *Properties) SumInt(prefix string) (int64, error) {
+	p.resolve()
+	var sum int64
+	for _, k := range p.k {
+		if _, ok := p.cutPrefix(k, prefix); !ok {
+			continue
+		}
+		s, _ := p.get(k)
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("properties: invalid integer for key %s: %s", p.name(k), err)
+		}
+		sum += v
+	}
+	return sum, nil
+}
+
+// SumFloat64 returns the sum of the expanded values of all keys with the
+// given prefix parsed as float64. An error is returned if one of the values
+// is not a number.
+func (p *Properties) SumFloat64(prefix string) (float64, error) {
+	p.resolve()
+	var sum float64
+	for _, k := range p.k {
+		if _, ok := p.cutPrefix(k, prefix); !ok {
+			continue
+		}
+		s, _ := p.get(k)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("properties: invalid number for key %s: %s", p.name(k), err)
+		}
+		sum += v
+	}
+	return sum, nil
+}
+
+// CountFunc returns the number of key/value pairs for which pred returns
+// true. The values are passed in unexpanded form.
+func (p *Properties) CountFunc(pred func(key, value string) bool) int {
+	p.resolve()
+	n := 0
+	for _, k := range p.k {
+		if pred(p.name(k), p.m[k]) {
+			n++
+		}
+	}
+	return n
+}
+
+// Apply replaces every unexpanded value with the result of f. The keys and
+// their order are preserved. If f returns an error or one of the new values
+// contains a circular reference or a malformed expression then all values
+// are restored and the error is returned.
+func (p *Properties) Apply(f func(key, rawValue string) (string, error)) error {
+	p.resolve()
+	m := make(map[string]string, len(p.m))
+	for _, k := range p.k {
+		v, err := f(p.name(k), p.m[k])
+		if err != nil {
+			return err
+		}
+		m[k] = v
+	}
+
+	old := p.m
+	p.m = m
+	if !p.DisableExpansion {
+		if err := p.check(); err != nil {
+			p.m = old
+			return err
+		}
+	}
+	p.dirty = true
+	p.invalidate()
+	return nil
+}
+
+// ActivateProfile sets the value of every key 'base' to the value of the key
+// 'base@name' if it exists and removes all profile specific keys of the form
+// 'base@profile'. If this introduces a circular reference or a malformed
+// expression the properties remain unchanged and an error is returned.
+func (p *Properties) ActivateProfile(name string) error {
+	p.resolve()
+	m := make(map[string]string, len(p.m))
+	var keys []string
+	for _, k := range p.k {
+		if _, _, ok := profileKey(k); ok {
+			continue
+		}
+		m[k] = p.m[k]
+		keys = append(keys, k)
+	}
+	for _, k := range p.k {
+		base, profile, ok := profileKey(k)
+		if !ok || profile != p.normKey(name) {
+			continue
+		}
+		if _, ok := m[base]; !ok {
+			keys = append(keys, base)
+		}
+		m[base] = p.m[k]
+	}
+
+	old := p.m
+	p.m = m
+	if !p.DisableExpansion {
+		if err := p.check(); err != nil {
+			p.m = old
+			return err
+		}
+	}
+	for _, k := range p.k {
+		if _, ok := m[k]; !ok {
+			delete(p.c, k)
+			delete(p.cc, k)
+			delete(p.names, k)
+		}
+	}
+	p.k = keys
+	p.dirty = true
+	p.invalidate()
+	return nil
+}
+
+// profileKey splits a key of the form 'base@profile' into its parts. The
+// profile name must consist of letters, digits, '-' and '_' so that keys
+// like 'admin@example.com' are not mistaken for profile keys.
+func profileKey(k string) (base, profile string, ok bool) {
+	i := strings.LastIndex(k, "@")
+	if i <= 0 || i == len(k)-1 {
+		return "", "", false
+	}
+	for _, r := range k[i+1:] {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", "", false
+		}
+	}
+	return k[:i], k[i+1:], true
+}
+
+// ----------------------------------------------------------------------------
+
+// Delete removes the key and its comments.
+func (p *Properties) Delete(key string) {
+	p.resolve()
+	key = p.normKey(key)
+	delete(p.m, key)
+	delete(p.c, key)
+	delete(p.cc, key)
+	delete(p.names, key)
+	delete(p.sources, key)
+	delete(p.encodings, key)
+	newKeys := []string{}
+	for _, k := range p.k {
+		if k != key {
+			newKeys = append(newKeys, k)
+		}
+	}
+	p.k = newKeys
+	p.dirty = true
+	p.invalidate()
+}
+
+// Pop removes the key and its comments like Delete and returns its
+// expanded value. If the key does not exist then existed is false and
+// nothing is removed.
+func (p *Properties) Pop(key string) (value string, existed bool) {
+	if !p.Has(key) {
+		return "", false
+	}
+	value, _ = p.get(key)
+	p.Delete(key)
+	return value, true
+}
+
+// Merge returns a new Properties struct with the properties, comments and
+// keys of all ps merged from left to right. Values of later properties
+// override earlier ones. The settings like Prefix and Postfix are taken
+// from the first properties. Nil properties are ignored.
+func Merge(ps ...*Properties) *Properties {
+	var all *Properties
+	for _, p := range ps {
+		switch {
+		case p == nil:
+			continue
+		case all == nil:
+			all = p.clone()
+		default:
+			all.Merge(p)
+		}
+	}
+	if all == nil {
+		return NewProperties()
+	}
+	return all
+}
+
+// Merge merges properties, comments and keys from other *Properties into p
+func (p *Properties) Merge(other *Properties) {
+	p.resolve()
+	other.resolve()
+	for _, k := range other.k {
+		if _, ok := p.m[k]; !ok {
+			p.k = append(p.k, k)
+		}
+	}
+	for k, v := range other.m {
+		p.m[k] = v
+		if raw, ok := other.rawTexts[k]; ok {
+			p.setRawText(k, raw.text, raw.value)
+		} else {
+			delete(p.rawTexts, k)
+		}
+		if src, ok := other.sources[k]; ok {
+			if p.sources == nil {
+				p.sources = map[string]string{}
+			}
+			p.sources[k] = src
+		} else {
+			delete(p.sources, k)
+		}
+		if e, ok := other.encodings[k]; ok {
+			p.SetEncoding(k, e)
+		}
+	}
+	for k, v := range other.c {
+		p.c[k] = v
+		if chars, ok := other.cc[k]; ok {
+			p.setCommentChars(k, chars)
+		} else {
+			delete(p.cc, k)
+		}
+	}
+	for k, v := range other.names {
+		p.setName(k, v)
+	}
+	if other.trailingComments != nil {
+		p.trailingComments, p.trailingCommentChars, p.trailingBlank = other.trailingComments, other.trailingCommentChars, other.trailingBlank
+	}
+	p.dirty = true
+	p.invalidate()
+}
+
+// ----------------------------------------------------------------------------
+
+// RawText returns the original text of the value for the given key as it
+// was written in the input including escape sequences and line
+// continuations if the properties were loaded with PreserveFormatting.
+// If the value was set or modified after loading or the original text is
+// not known, the unexpanded value is returned encoded as by Write. ok is
+// false if the key does not exist.
+func (p *Properties) RawText(key string) (text string, ok bool) {
+	p.resolve()
+	key = p.normKey(key)
+	v, ok := p.m[key]
+	if !ok {
+		return "", false
+	}
+	if raw, ok := p.rawTexts[key]; ok && raw.value == v {
+		return raw.text, true
+	}
+	return p.encodeValue(v, UTF8), true
 }
 
-// FilterPrefix returns a new properties object with a subset of all keys
-// with the given prefix.
-func (p *Properties) FilterPrefix(prefix string) *Properties {
-	pp := NewProperties()
-	for _, k := range p.k {
-		if strings.HasPrefix(k, prefix) {
-			// TODO(fs): we are ignoring the error which flags a circular reference.
-			// TODO(fs): since we are just copying a subset of keys this cannot happen (fingers crossed)
-			pp.Set(k, p.m[k])
-		}
+// setRawText records the original text of the value for key.
+func (p *Properties) setRawText(key, text, value string) {
+	if p.rawTexts == nil {
+		p.rawTexts = map[string]rawText{}
 	}
-	return pp
+	p.rawTexts[key] = rawText{text, value}
 }
 
-// FilterStripPrefix returns a new properties object with a subset of all keys
-// with the given prefix and the prefix removed from the keys.
-func (p *Properties) FilterStripPrefix(prefix string) *Properties {
-	pp := NewProperties()
-	n := len(prefix)
+// Touch marks the key as accessed without reading it, e.g. for keys which
+// are consumed indirectly, so that it is not reported by Unused.
+func (p *Properties) Touch(key string) {
+	p.touch(p.normKey(key))
+}
+
+// Unused returns the keys which have not been read with Get or one of the
+// typed getters while TrackAccess was set and which have not been touched
+// with Touch. The keys are returned in order.
+func (p *Properties) Unused() []string {
+	p.resolve()
+	trackMu.Lock()
+	defer trackMu.Unlock()
+	keys := []string{}
 	for _, k := range p.k {
-		if len(k) > len(prefix) && strings.HasPrefix(k, prefix) {
-			// TODO(fs): we are ignoring the error which flags a circular reference.
-			// TODO(fs): since we are modifying keys I am not entirely sure whether we can create a circular reference
-			// TODO(fs): this function should probably return an error but the signature is fixed
-			pp.Set(k[n:], p.m[k])
+		if !p.accessed[k] {
+			keys = append(keys, p.name(k))
 		}
 	}
-	return pp
+	return keys
 }
 
-// Len returns the number of keys.
-func (p *Properties) Len() int {
-	return len(p.m)
+// trackMu guards the keys which Get records for TrackAccess and for the
+// warnings of deprecated keys so that Get can be called by concurrent
+// readers.
+var trackMu sync.Mutex
+
+// touch marks the normalized key as accessed.
+func (p *Properties) touch(key string) {
+	trackMu.Lock()
+	defer trackMu.Unlock()
+	if p.accessed == nil {
+		p.accessed = map[string]bool{}
+	}
+	p.accessed[key] = true
 }
 
-// Keys returns all keys in the same order as in the input.
-func (p *Properties) Keys() []string {
-	keys := make([]string, len(p.k))
-	copy(keys, p.k)
-	return keys
+// Source returns the name of the file or URL which provided the value
+// for the given key when the properties were loaded with LoadFile,
+// LoadAll or LoadFSGlob. ok is false if the key does not exist or its value was
+// not loaded from a file or URL, e.g. because it was set with Set.
+func (p *Properties) Source(key string) (name string, ok bool) {
+	p.resolve()
+	name, ok = p.sources[p.normKey(key)]
+	return name, ok
 }
 
-// Set sets the property key to the corresponding value.
-// If a value for key existed before then ok is true and prev
-// contains the previous value. If the value contains a
-// circular reference or a malformed expression then
-// an error is returned.
-// An empty key is silently ignored.
-func (p *Properties) Set(key, value string) (prev string, ok bool, err error) {
-	if key == "" {
-		return "", false, nil
+// ResolvePath returns the expanded value for the given key as a path
+// relative to the directory of the file which provided the value. The
+// joined path is cleaned. Absolute and empty values and values which
+// were not loaded from a file are returned unchanged. See Source.
+func (p *Properties) ResolvePath(key string) (path string, ok bool) {
+	path, ok = p.Get(key)
+	if !ok || path == "" || filepath.IsAbs(path) {
+		return path, ok
 	}
+	src, ok := p.Source(key)
+	if !ok || strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		return path, true
+	}
+	return filepath.Join(filepath.Dir(src), path), true
+}
 
-	// if expansion is disabled we allow circular references
-	if p.DisableExpansion {
-		prev, ok = p.Get(key)
-		p.m[key] = value
-		if !ok {
-			p.k = append(p.k, key)
-		}
-		return prev, ok, nil
+// setSource records name as the source of all keys.
+func (p *Properties) setSource(name string) {
+	if p.sources == nil {
+		p.sources = make(map[string]string, len(p.k))
+	}
+	for _, k := range p.k {
+		p.sources[k] = name
 	}
+}
 
-	// to check for a circular reference we temporarily need
-	// to set the new value. If there is an error then revert
-	// to the previous state. Only if all tests are successful
-	// then we add the key to the p.k list.
-	prev, ok = p.Get(key)
-	p.m[key] = value
+// OnKeyChange registers f to be called by Reload when the unexpanded value
+// of the given key changes. old is empty if the key was added and new is
+// empty if the key was removed.
+func (p *Properties) OnKeyChange(key string, f func(old, new string)) {
+	if p.watchers == nil {
+		p.watchers = map[string][]func(old, new string){}
+	}
+	key = p.normKey(key)
+	p.watchers[key] = append(p.watchers[key], f)
+}
 
-	// now check for a circular reference
-	_, err = p.expand(key, value)
+// Reload reads the files and URLs again which the properties were loaded
+// from with LoadAll or one of the functions which use it, like LoadFile,
+// and replaces all keys, values and comments. The settings are preserved.
+// Then the callbacks registered with OnKeyChange are called for the keys
+// whose unexpanded values have changed in the order of the keys. If the
+// properties cannot be loaded they remain unchanged and the error is
+// returned.
+func (p *Properties) Reload() error {
+	p.resolve()
+	if p.reload == nil {
+		return fmt.Errorf("properties: no sources to reload")
+	}
+	pp, err := p.reload()
 	if err != nil {
+		return err
+	}
 
-		// revert to the previous state
-		if ok {
-			p.m[key] = prev
-		} else {
-			delete(p.m, key)
-		}
+	old, oldKeys := p.m, p.k
+	p.m, p.c, p.cc, p.k, p.names = pp.m, pp.c, pp.cc, pp.k, pp.names
+	p.rawTexts, p.sources, p.raw, p.rawEnc = pp.rawTexts, pp.sources, pp.raw, pp.rawEnc
+	p.dirty = false
+	p.invalidate()
 
-		return "", false, err
+	if len(p.watchers) == 0 {
+		return nil
 	}
-
-	if !ok {
-		p.k = append(p.k, key)
+	keys := append([]string(nil), p.k...)
+	for _, k := range oldKeys {
+		if _, ok := p.m[k]; !ok {
+			keys = append(keys, k)
+		}
 	}
-
-	return prev, ok, nil
+	for _, k := range keys {
+		o, ok1 := old[k]
+		n, ok2 := p.m[k]
+		if o == n && ok1 == ok2 {
+			continue
+		}
+		for _, f := range p.watchers[k] {
+			f(o, n)
+		}
+	}
+	return nil
 }
 
-// SetValue sets property key to the default string value
-// as defined by fmt.Sprintf("%v").
-func (p *Properties) SetValue(key string, value interface{}) error {
-	_, _, err := p.Set(key, fmt.Sprintf("%v", value))
-	return err
+// Err returns the error which occurred when the properties of LazyLoadFile
+// were loaded or nil.
+func (p *Properties) Err() error {
+	p.resolve()
+	if p.lazy == nil {
+		return nil
+	}
+	return p.lazy.err
 }
 
-// MustSet sets the property key to the corresponding value.
-// If a value for key existed before then ok is true and prev
-// contains the previous value. An empty key is silently ignored.
-func (p *Properties) MustSet(key, value string) (prev string, ok bool) {
-	prev, ok, err := p.Set(key, value)
-	if err != nil {
-		ErrorHandler(err)
-	}
-	return prev, ok
+// lazyLoad loads the properties of LazyLoadFile once.
+type lazyLoad struct {
+	once sync.Once
+	load func() (*Properties, error)
+	err  error
 }
 
-// String returns a string of all expanded 'key = value' pairs.
-func (p *Properties) String() string {
-	var s string
-	for _, key := range p.k {
-		value, _ := p.Get(key)
-		s = fmt.Sprintf("%s%s = %s\n", s, key, value)
+// resolve loads the properties of LazyLoadFile on first access. Concurrent
+// readers wait until the properties are loaded. Errors are recorded for
+// Err and the Must functions.
+func (p *Properties) resolve() {
+	if p.lazy == nil {
+		return
 	}
-	return s
+	p.lazy.once.Do(func() {
+		pp, err := p.lazy.load()
+		if err != nil {
+			p.lazy.err = err
+			return
+		}
+		p.m, p.c, p.cc, p.k, p.names, p.rawTexts = pp.m, pp.c, pp.cc, pp.k, pp.names, pp.rawTexts
+		p.sources, p.reload = pp.sources, pp.reload
+		p.trailingComments, p.trailingCommentChars, p.trailingBlank = pp.trailingComments, pp.trailingCommentChars, pp.trailingBlank
+	})
 }
 
-// Sort sorts the properties keys in alphabetical order.
-// This is helpfully before writing the properties.
-func (p *Properties) Sort() {
-	sort.Strings(p.k)
+// mustResolve loads the properties of LazyLoadFile like resolve and
+// passes the error to the ErrorHandler.
+func (p *Properties) mustResolve() {
+	if err := p.Err(); err != nil {
+		ErrorHandler(err)
+	}
 }
 
-// Write writes all unexpanded 'key = value' pairs to the given writer.
-// Write returns the number of bytes written and any write error encountered.
-func (p *Properties) Write(w io.Writer, enc Encoding) (n int, err error) {
-	return p.WriteComment(w, "", enc)
+// normKey returns the key under which the value for key is stored.
+func (p *Properties) normKey(key string) string {
+	if !p.IgnoreCase {
+		return key
+	}
+	return foldKey(key)
 }
 
-// WriteComment writes all unexpanced 'key = value' pairs to the given writer.
-// If prefix is not empty then comments are written with a blank line and the
-// given prefix. The prefix should be either "# " or "! " to be compatible with
-// the properties file format. Otherwise, the properties parser will not be
-// able to read the file back in. It returns the number of bytes written and
-// any write error encountered.
-func (p *Properties) WriteComment(w io.Writer, prefix string, enc Encoding) (n int, err error) {
-	var x int
-
-	for _, key := range p.k {
-		value := p.m[key]
-
-		if prefix != "" {
-			if comments, ok := p.c[key]; ok {
-				// don't print comments if they are all empty
-				allEmpty := true
-				for _, c := range comments {
-					if c != "" {
-						allEmpty = false
-						break
-					}
-				}
-
-				if !allEmpty {
-					// add a blank line between entries but not at the top
-					if len(comments) > 0 && n > 0 {
-						x, err = fmt.Fprintln(w)
-						if err != nil {
-							return
-						}
-						n += x
-					}
-
-					for _, c := range comments {
-						x, err = fmt.Fprintf(w, "%s%s\n", prefix, c)
-						if err != nil {
-							return
-						}
-						n += x
-					}
-				}
-			}
+// foldKey returns the case folded form of the key which is used for case
+// insensitive matching. Runes are mapped to the lower case form of their
+// case folding orbit so that e.g. the Kelvin sign matches 'k' and the
+// long s matches 's'. The sharp s 'ß' and its upper case form 'ẞ' are
+// folded to "ss". The Turkish 'İ' is folded to 'i' while the dotless 'ı'
+// only matches itself as in the default Unicode case folding.
+func foldKey(key string) string {
+	ascii := true
+	for i := 0; i < len(key); i++ {
+		if key[i] >= utf8.RuneSelf {
+			ascii = false
+			break
 		}
-		sep := " = "
-		if p.WriteSeparator != "" {
-			sep = p.WriteSeparator
+	}
+	if ascii {
+		return strings.ToLower(key)
+	}
+
+	var b strings.Builder
+	for _, r := range key {
+		if r == 'ß' || r == 'ẞ' {
+			b.WriteString("ss")
+			continue
 		}
-		x, err = fmt.Fprintf(w, "%s%s%s\n", encode(key, " :", enc), sep, encode(value, "", enc))
-		if err != nil {
-			return
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
 		}
-		n += x
+		b.WriteRune(unicode.ToLower(min))
 	}
-	return
+	return b.String()
 }
 
-// Map returns a copy of the properties as a map.
-func (p *Properties) Map() map[string]string {
-	m := make(map[string]string)
-	for k, v := range p.m {
-		m[k] = v
+// name returns the original form of the stored key.
+func (p *Properties) name(key string) string {
+	if name, ok := p.names[key]; ok {
+		return name
 	}
-	return m
+	return key
 }
 
-// FilterFunc returns a copy of the properties which includes the values which passed all filters.
-func (p *Properties) FilterFunc(filters ...func(k, v string) bool) *Properties {
-	pp := NewProperties()
-outer:
-	for k, v := range p.m {
-		for _, f := range filters {
-			if !f(k, v) {
-				continue outer
-			}
-			pp.Set(k, v)
-		}
+// setName records the original form of the stored key.
+func (p *Properties) setName(key, name string) {
+	if key == name {
+		delete(p.names, key)
+		return
 	}
-	return pp
+	if p.names == nil {
+		p.names = map[string]string{}
+	}
+	p.names[key] = name
 }
 
-// ----------------------------------------------------------------------------
-
-// Delete removes the key and its comments.
-func (p *Properties) Delete(key string) {
-	delete(p.m, key)
-	delete(p.c, key)
-	newKeys := []string{}
-	for _, k := range p.k {
-		if k != key {
-			newKeys = append(newKeys, k)
+// foldKeys converts all keys to their case-insensitive form and
+// records the original keys.
+func (p *Properties) foldKeys() {
+	m, c, k := map[string]string{}, map[string][]string{}, []string{}
+	raw := p.rawTexts
+	p.rawTexts = nil
+	for _, name := range p.k {
+		key := p.normKey(name)
+		if _, ok := m[key]; !ok {
+			k = append(k, key)
+		}
+		m[key] = p.m[name]
+		if comments, ok := p.c[name]; ok {
+			c[key] = comments
 		}
+		if chars, ok := p.cc[name]; ok {
+			delete(p.cc, name)
+			p.setCommentChars(key, chars)
+		}
+		if r, ok := raw[name]; ok {
+			p.setRawText(key, r.text, r.value)
+		}
+		p.setName(key, name)
 	}
-	p.k = newKeys
+	p.m, p.c, p.k = m, c, k
 }
 
-// Merge merges properties, comments and keys from other *Properties into p
-func (p *Properties) Merge(other *Properties) {
-	for _, k := range other.k {
-		if _, ok := p.m[k]; !ok {
-			p.k = append(p.k, k)
-		}
+// cutPrefix returns the original form of the stored key without the
+// prefix and whether the key has the prefix. The prefix is matched
+// case-insensitively if IgnoreCase is set.
+func (p *Properties) cutPrefix(key, prefix string) (string, bool) {
+	nprefix := p.normKey(prefix)
+	if !strings.HasPrefix(key, nprefix) {
+		return "", false
 	}
-	for k, v := range other.m {
-		p.m[k] = v
+	name := p.name(key)
+	if name == key {
+		return key[len(nprefix):], true
 	}
-	for k, v := range other.c {
-		p.c[k] = v
+
+	// case folding can change the length of the prefix
+	for i := range name {
+		if p.normKey(name[:i]) == nprefix {
+			return name[i:], true
+		}
 	}
+	return "", true
+}
+
+// newFiltered returns an empty properties object for a subset of the keys
+// which matches keys like p.
+func (p *Properties) newFiltered() *Properties {
+	pp := NewProperties()
+	pp.IgnoreCase = p.IgnoreCase
+	return pp
 }
 
 // ----------------------------------------------------------------------------
@@ -828,27 +3273,111 @@ func (p *Properties) check() error {
 	return nil
 }
 
+// UnresolvedRefs returns the keys which are referenced in expressions of the
+// values but are neither defined as properties nor as environment variables.
+// The keys are returned in order of their first appearance. Malformed
+// expressions are ignored since they are reported by the expansion.
+func (p *Properties) UnresolvedRefs() []string {
+	p.resolve()
+	if p.Prefix == "" && p.Postfix == "" {
+		return nil
+	}
+
+	var refs []string
+	seen := map[string]bool{}
+	for _, k := range p.k {
+		for _, ref := range references(p.m[k], p.Prefix, p.Postfix) {
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			if _, ok := p.m[p.normKey(ref)]; ok {
+				continue
+			}
+			if _, ok := os.LookupEnv(ref); ok {
+				continue
+			}
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// references returns the keys of all '(prefix)key(postfix)' expressions
+// in s in order of appearance. The keys of expressions with a fallback
+// value are skipped but the references in the fallback are included. It
+// stops at the first malformed expression.
+func references(s, prefix, postfix string) []string {
+	var keys []string
+	for {
+		start := strings.Index(s, prefix)
+		if start == -1 {
+			return keys
+		}
+		if prefixEscape(s, start, prefix) > 0 {
+			s = s[start+len(prefix):]
+			continue
+		}
+		keyStart := start + len(prefix)
+		if _, fallback, end, ok := parseFallback(s, keyStart, prefix, postfix); ok {
+			if end == -1 {
+				return keys
+			}
+			keys = append(keys, references(fallback, prefix, postfix)...)
+			s = s[end+len(postfix):]
+			continue
+		}
+		keyLen := strings.Index(s[keyStart:], postfix)
+		if keyLen == -1 {
+			return keys
+		}
+		keys = append(keys, s[keyStart:keyStart+keyLen])
+		s = s[keyStart+keyLen+len(postfix):]
+	}
+}
+
 func (p *Properties) expand(key, input string) (string, error) {
 	// no pre/postfix -> nothing to expand
 	if p.Prefix == "" && p.Postfix == "" {
 		return input, nil
 	}
 
-	return expand(input, []string{key}, p.Prefix, p.Postfix, p.m)
+	return expand(input, []string{key}, p.Prefix, p.Postfix, p.m, p.SelfRefFromEnv, p.IgnoreCase)
 }
 
 // expand recursively expands expressions of '(prefix)key(postfix)' to their corresponding values.
 // The function keeps track of the keys that were already expanded and stops if it
 // detects a circular reference or a malformed expression of the form '(prefix)key'.
-func expand(s string, keys []string, prefix, postfix string, values map[string]string) (string, error) {
+//
+// A backslash or the first character of the prefix directly before the
+// prefix escapes it and the expression is kept as literal text without
+// the escape, e.g. '\${key}' and '$${key}' expand to '${key}'.
+//
+// Keys without a value are expanded with the value of the environment
+// variable with the same name. An expression of the form
+// '(prefix)key:-fallback(postfix)' is expanded with the expanded fallback
+// value if the key has neither a value nor an environment variable. The
+// fallback can contain expressions. If selfRefFromEnv is true then a circular
+// reference is resolved with the value of the environment variable if it
+// exists. If ignoreCase is true then the keys of the expressions are case
+// folded before they are looked up in values.
+func expand(s string, keys []string, prefix, postfix string, values map[string]string, selfRefFromEnv, ignoreCase bool) (string, error) {
 	if len(keys) > maxExpansionDepth {
 		return "", fmt.Errorf("expansion too deep")
 	}
 
+	head := ""
 	for {
 		start := strings.Index(s, prefix)
 		if start == -1 {
-			return s, nil
+			return head + s, nil
+		}
+
+		// an escaped prefix is kept as literal text without the escape
+		if n := prefixEscape(s, start, prefix); n > 0 {
+			head += s[:start-n] + prefix
+			s = s[start+len(prefix):]
+			continue
 		}
 
 		keyStart := start + len(prefix)
@@ -860,29 +3389,131 @@ func expand(s string, keys []string, prefix, postfix string, values map[string]s
 		end := keyStart + keyLen + len(postfix) - 1
 		key := s[keyStart : keyStart+keyLen]
 
+		fallback, hasFallback := "", false
+		if k, f, e, ok := parseFallback(s, keyStart, prefix, postfix); ok {
+			if e == -1 {
+				return "", fmt.Errorf("malformed expression")
+			}
+			key, fallback, hasFallback, end = k, f, true, e+len(postfix)-1
+		}
+
 		// fmt.Printf("s:%q pp:%q start:%d end:%d keyStart:%d keyLen:%d key:%q\n", s, prefix + "..." + postfix, start, end, keyStart, keyLen, key)
 
+		// environment variables are looked up with the key as written
+		ref := key
+		if ignoreCase {
+			ref = foldKey(key)
+		}
+
+		circular := false
 		for _, k := range keys {
-			if key == k {
-				var b bytes.Buffer
-				b.WriteString("circular reference in:\n")
-				for _, k1 := range keys {
-					fmt.Fprintf(&b, "%s=%s\n", k1, values[k1])
-				}
-				return "", fmt.Errorf(b.String())
+			if ref == k {
+				circular = true
+				break
 			}
 		}
+		if circular {
+			// the value of the environment variable is not expanded
+			if val, ok := os.LookupEnv(key); ok && selfRefFromEnv {
+				head += s[:start] + val
+				s = s[end+1:]
+				continue
+			}
+			var b bytes.Buffer
+			b.WriteString("circular reference in:\n")
+			for _, k1 := range keys {
+				fmt.Fprintf(&b, "%s=%s\n", k1, values[k1])
+			}
+			return "", fmt.Errorf(b.String())
+		}
 
-		val, ok := values[key]
+		val, ok := values[ref]
 		if !ok {
-			val = os.Getenv(key)
+			val, ok = os.LookupEnv(key)
+		}
+		var new_val string
+		var err error
+		if !ok && hasFallback {
+			new_val, err = expand(fallback, keys, prefix, postfix, values, selfRefFromEnv, ignoreCase)
+		} else {
+			new_val, err = expand(val, append(keys, ref), prefix, postfix, values, selfRefFromEnv, ignoreCase)
 		}
-		new_val, err := expand(val, append(keys, key), prefix, postfix, values)
 		if err != nil {
 			return "", err
 		}
-		s = s[:start] + new_val + s[end+1:]
+
+		// the expanded value is not scanned again since it
+		// can contain escaped expressions
+		head += s[:start] + new_val
+		s = s[end+1:]
+	}
+}
+
+// prefixEscape returns the length of the escape directly before the
+// prefix at s[start:] or 0 if the prefix is not escaped. The escape is
+// either a backslash or the first character of the prefix.
+func prefixEscape(s string, start int, prefix string) int {
+	if start > 0 && s[start-1] == '\\' {
+		return 1
+	}
+	if _, w := utf8.DecodeRuneInString(prefix); w > 0 && strings.HasSuffix(s[:start], prefix[:w]) {
+		return w
+	}
+	return 0
+}
+
+// fallbackSep separates the key from the fallback value in an expression
+// of the form '(prefix)key:-fallback(postfix)'.
+const fallbackSep = ":-"
+
+// parseFallback parses an expression of the form
+// '(prefix)key:-fallback(postfix)' which starts with the key at
+// s[keyStart:]. The fallback can contain nested expressions. end is the
+// index of the matching postfix or -1 if the expression is not terminated.
+// ok is false if the expression has no fallback.
+func parseFallback(s string, keyStart int, prefix, postfix string) (key, fallback string, end int, ok bool) {
+	if prefix == "" || postfix == "" {
+		return "", "", 0, false
+	}
+	i := strings.Index(s[keyStart:], fallbackSep)
+	if i == -1 {
+		return "", "", 0, false
+	}
+	key = s[keyStart : keyStart+i]
+	if strings.Contains(key, postfix) || strings.Contains(key, prefix) {
+		return "", "", 0, false
+	}
+
+	// find the postfix which matches the prefix of the expression
+	fallbackStart := keyStart + i + len(fallbackSep)
+	depth, pos := 1, fallbackStart
+	for {
+		post := strings.Index(s[pos:], postfix)
+		if post == -1 {
+			return key, "", -1, true
+		}
+		if pre := strings.Index(s[pos:], prefix); pre != -1 && pre < post {
+			if prefixEscape(s, pos+pre, prefix) == 0 {
+				depth++
+			}
+			pos += pre + len(prefix)
+			continue
+		}
+		depth--
+		if depth == 0 {
+			return key, s[fallbackStart : pos+post], pos + post, true
+		}
+		pos += post + len(postfix)
+	}
+}
+
+// encode encodes a string for writing with the given encoding and escapes
+// all non-ASCII characters if EscapeNonASCII is set.
+func (p *Properties) encode(s string, special string, enc Encoding) string {
+	if p.EscapeNonASCII {
+		return encodeASCII(s, special)
 	}
+	return encode(s, special, enc)
 }
 
 // encode encodes a UTF-8 string to ISO-8859-1 and escapes some characters.
@@ -925,6 +3556,21 @@ func encodeIso(s string, special string) string {
 	return v
 }
 
+func encodeASCII(s string, special string) string {
+	var v string
+	for _, r := range s {
+		switch {
+		case r < 1<<7: // ASCII -> escape special chars only
+			v += escape(r, special)
+		case r < 1<<16: // unicode literal
+			v += fmt.Sprintf("\\u%04x", r)
+		default: // more than two bytes per rune -> can't encode
+			v += "?"
+		}
+	}
+	return v
+}
+
 func escape(r rune, special string) string {
 	switch r {
 	case '\f':
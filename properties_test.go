@@ -8,11 +8,14 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"net"
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -39,6 +42,12 @@ var complexTests = [][]string{
 	{"key1=value1\rkey2=value2\r", "key1", "value1", "key2", "value2"},
 	{"key1=value1\r\nkey2=value2\r\n", "key1", "value1", "key2", "value2"},
 
+	// bare keys without delimiter and value
+	{"key1=value1\nfeature.enabled\nkey2=value2", "key1", "value1", "feature.enabled", "", "key2", "value2"},
+	{"key1=value1\nfeature.enabled", "key1", "value1", "feature.enabled", ""},
+	{"key1=value1\nfeature.enabled\n", "key1", "value1", "feature.enabled", ""},
+	{"feature.enabled\r\nkey2=value2", "feature.enabled", "", "key2", "value2"},
+
 	// blank lines
 	{"\nkey=value\n", "key", "value"},
 	{"\rkey=value\r", "key", "value"},
@@ -79,6 +88,15 @@ var complexTests = [][]string{
 	{"key = valueA,\\\n\f\f\fvalueB", "key", "valueA,valueB"}, // FF indent
 	{"key = valueA,\\\n\t\t\tvalueB", "key", "valueA,valueB"}, // TAB indent
 	{"key = valueA,\\\n \f\tvalueB", "key", "valueA,valueB"},  // mix indent
+	{"key = valueA,\\\r\n    valueB", "key", "valueA,valueB"}, // CRLF
+	{"key = valueA,\\\r    valueB", "key", "valueA,valueB"},   // CR
+
+	// multiline keys
+	{"ke\\\ny = value", "key", "value"},
+	{"ke\\\n    y = value", "key", "value"},
+	{"ke\\\r\n\ty = value", "key", "value"},
+	{"ke\\\n  y\\\n  2 = value\nk3=v", "key2", "value", "k3", "v"},
+	{"key\\\n  = value", "key", "value"},
 
 	// comments
 	{"# this is a comment\n! and so is this\nkey1=value1\nkey#2=value#2\n\nkey!3=value!3\n# and another one\n! and the final one", "key1", "value1", "key#2", "value#2", "key!3", "value!3"},
@@ -595,6 +613,143 @@ func TestMustGet(t *testing.T) {
 	assert.Panic(t, func() { p.MustGet("invalid") }, "unknown property: invalid")
 }
 
+func TestTryGet(t *testing.T) {
+	p := mustParse(t, "key = value\nkey2 = ${key}2")
+	v, err := p.TryGet("key2")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, "value2")
+
+	_, err = p.TryGet("missing")
+	assert.Equal(t, err.Error(), "unknown property: missing")
+
+	// circular references can only be introduced with disabled expansion
+	p.DisableExpansion = true
+	p.MustSet("a", "${b}")
+	p.MustSet("b", "${a}")
+	p.MustSet("c", "${d")
+	v, err = p.TryGet("a")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, "${b}")
+
+	p.DisableExpansion = false
+	_, err = p.TryGet("a")
+	assert.Matches(t, err.Error(), "circular reference")
+	_, err = p.TryGet("c")
+	assert.Matches(t, err.Error(), "malformed expression")
+	assert.Panic(t, func() { p.Get("a") }, "circular reference")
+}
+
+func TestHas(t *testing.T) {
+	p := mustParse(t, "key = value\nempty =")
+	assert.Equal(t, p.Has("key"), true)
+	assert.Equal(t, p.Has("empty"), true)
+	assert.Equal(t, p.Has("missing"), false)
+
+	// the value is not expanded
+	p.DisableExpansion = true
+	p.MustSet("a", "${b}")
+	p.MustSet("b", "${a}")
+	p.MustSet("c", "${d")
+	p.DisableExpansion = false
+	assert.Equal(t, p.Has("a"), true)
+	assert.Equal(t, p.Has("c"), true)
+
+	p.TrackAccess = true
+	p.Has("key")
+	assert.Equal(t, p.Unused(), []string{"key", "empty", "a", "b", "c"})
+}
+
+func TestExpansionCache(t *testing.T) {
+	p := mustParse(t, "a = 1\nb = ${a}/2\nc = ${b}/3")
+	p.EnableExpansionCache()
+	assert.Equal(t, p.MustGet("c"), "1/2/3")
+
+	p.MustSet("a", "x")
+	assert.Equal(t, p.MustGet("c"), "x/2/3")
+
+	p.Merge(mustParse(t, "b = y"))
+	assert.Equal(t, p.MustGet("c"), "y/3")
+
+	p.Delete("b")
+	assert.Equal(t, p.MustGet("c"), "/3")
+
+	p.MustSet("b", "#[a]")
+	p.MustSet("c", "#[b]/3")
+	assert.Equal(t, p.MustGet("c"), "#[b]/3")
+	p.Prefix, p.Postfix = "#[", "]"
+	assert.Equal(t, p.MustGet("c"), "x/3")
+
+	// copies have their own cache
+	pp := Merge(p)
+	pp.MustSet("a", "z")
+	assert.Equal(t, pp.MustGet("c"), "z/3")
+	assert.Equal(t, p.MustGet("c"), "x/3")
+
+	// concurrent readers
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := p.MustGet("c"); got != "x/3" {
+					t.Errorf("got %q want %q", got, "x/3")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetE(t *testing.T) {
+	p := mustParse(t, "b = yes\nd = 5\npd = 2s\nf = 1.5\ni = -3\nu = 3\nbad = x\nbig = 99999999999")
+
+	v, err := p.GetBoolE("b")
+	assert.Equal(t, v, true)
+	assert.Equal(t, err, nil)
+	_, err = p.GetBoolE("missing")
+	assert.Equal(t, err.Error(), "unknown property: missing")
+
+	tests := []struct {
+		key  string
+		get  func(key string) (interface{}, error)
+		want interface{}
+		bad  string
+	}{
+		{"d", func(k string) (interface{}, error) { return p.GetDurationE(k) }, time.Duration(5), `strconv.ParseInt: parsing "x": invalid syntax`},
+		{"pd", func(k string) (interface{}, error) { return p.GetParsedDurationE(k) }, 2 * time.Second, `time: invalid duration`},
+		{"f", func(k string) (interface{}, error) { return p.GetFloat64E(k) }, 1.5, `strconv.ParseFloat: parsing "x": invalid syntax`},
+		{"f", func(k string) (interface{}, error) { return p.GetFloat32E(k) }, float32(1.5), `strconv.ParseFloat: parsing "x": invalid syntax`},
+		{"i", func(k string) (interface{}, error) { return p.GetIntE(k) }, -3, `strconv.ParseInt: parsing "x": invalid syntax`},
+		{"i", func(k string) (interface{}, error) { return p.GetInt32E(k) }, int32(-3), `strconv.ParseInt: parsing "x": invalid syntax`},
+		{"i", func(k string) (interface{}, error) { return p.GetInt64E(k) }, int64(-3), `strconv.ParseInt: parsing "x": invalid syntax`},
+		{"u", func(k string) (interface{}, error) { return p.GetUintE(k) }, uint(3), `strconv.ParseUint: parsing "x": invalid syntax`},
+		{"u", func(k string) (interface{}, error) { return p.GetUint32E(k) }, uint32(3), `strconv.ParseUint: parsing "x": invalid syntax`},
+		{"u", func(k string) (interface{}, error) { return p.GetUint64E(k) }, uint64(3), `strconv.ParseUint: parsing "x": invalid syntax`},
+	}
+	for _, test := range tests {
+		v, err := test.get(test.key)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, v, test.want)
+
+		_, err = test.get("bad")
+		assert.Matches(t, err.Error(), regexp.QuoteMeta(test.bad))
+
+		_, err = test.get("missing")
+		assert.Equal(t, err.Error(), "unknown property: missing")
+	}
+
+	_, err = p.GetInt32E("big")
+	assert.Matches(t, err.Error(), "value out of range")
+
+	defer func(v bool) { is32Bit = v }(is32Bit)
+	is32Bit = true
+	_, err = p.GetIntE("big")
+	assert.Equal(t, err.Error(), "Value 99999999999 for key big out of range")
+	_, err = p.GetUintE("big")
+	assert.Equal(t, err.Error(), "Value 99999999999 for key big out of range")
+}
+
 func TestGetBool(t *testing.T) {
 	for _, test := range boolTests {
 		p := mustParse(t, test.input)
@@ -634,6 +789,24 @@ func TestGetParsedDuration(t *testing.T) {
 	}
 }
 
+func TestGetDurationInRange(t *testing.T) {
+	p := mustParse(t, "ok = 5s\nsmall = 10ms\nlarge = 2h\nbad = 5x\nmin = 1s\nmax = 1m")
+	def, min, max := 7*time.Second, time.Second, time.Minute
+	assert.Equal(t, p.GetDurationInRange("ok", def, min, max), 5*time.Second)
+	assert.Equal(t, p.GetDurationInRange("min", def, min, max), time.Second)
+	assert.Equal(t, p.GetDurationInRange("max", def, min, max), time.Minute)
+	assert.Equal(t, p.GetDurationInRange("small", def, min, max), def)
+	assert.Equal(t, p.GetDurationInRange("large", def, min, max), def)
+	assert.Equal(t, p.GetDurationInRange("bad", def, min, max), def)
+	assert.Equal(t, p.GetDurationInRange("missing", def, min, max), def)
+
+	assert.Equal(t, p.MustGetDurationInRange("ok", min, max), 5*time.Second)
+	assert.Panic(t, func() { p.MustGetDurationInRange("small", min, max) }, `duration 10ms for key small out of range \[1s, 1m0s\]`)
+	assert.Panic(t, func() { p.MustGetDurationInRange("large", min, max) }, `duration 2h0m0s for key large out of range`)
+	assert.Panic(t, func() { p.MustGetDurationInRange("bad", min, max) }, "unknown unit")
+	assert.Panic(t, func() { p.MustGetDurationInRange("missing", min, max) }, "unknown property: missing")
+}
+
 func TestGetFloat64(t *testing.T) {
 	for _, test := range float64Tests {
 		p := mustParse(t, test.input)
@@ -659,10 +832,11 @@ func TestGetFloat32(t *testing.T) {
 }
 
 func TestMustGetFloat32(t *testing.T) {
-	input := "key = 123\nkey2 = ghi"
+	input := "key = 123\nkey2 = ghi\nkey3 = 1e39"
 	p := mustParse(t, input)
 	assert.Equal(t, p.MustGetFloat32("key"), float32(123))
 	assert.Panic(t, func() { p.MustGetFloat32("key2") }, "strconv.ParseFloat: parsing.*")
+	assert.Panic(t, func() { p.MustGetFloat32("key3") }, "strconv.ParseFloat: parsing.*value out of range")
 	assert.Panic(t, func() { p.MustGetFloat32("invalid") }, "unknown property: invalid")
 }
 
@@ -777,6 +951,16 @@ func TestMustGetString(t *testing.T) {
 	assert.Panic(t, func() { p.MustGetString("invalid") }, "unknown property: invalid")
 }
 
+func TestGetFirstLine(t *testing.T) {
+	p := mustParse(t, "banner = line1\\nline2\\nline3\ncrlf = a\\r\\nb\nsingle = x\\ry\nempty = \\nrest\nref = >${banner}")
+	assert.Equal(t, p.GetFirstLine("banner", "def"), "line1")
+	assert.Equal(t, p.GetFirstLine("crlf", "def"), "a")
+	assert.Equal(t, p.GetFirstLine("single", "def"), "x\ry")
+	assert.Equal(t, p.GetFirstLine("empty", "def"), "")
+	assert.Equal(t, p.GetFirstLine("ref", "def"), ">line1")
+	assert.Equal(t, p.GetFirstLine("missing", "def"), "def")
+}
+
 func TestComment(t *testing.T) {
 	for _, test := range commentTests {
 		p := mustParse(t, test.input)
@@ -810,6 +994,55 @@ func TestComment(t *testing.T) {
 	}
 }
 
+func TestSetCommentBeforeKey(t *testing.T) {
+	p := NewProperties()
+	p.SetComment("key", "generated")
+	assert.Equal(t, p.GetComment("key"), "generated")
+	p.MustSet("key", "value")
+	p.MustSet("other", "1")
+
+	buf := new(bytes.Buffer)
+	_, err := p.WriteComment(buf, "# ", UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# generated\nkey = value\nother = 1\n")
+
+	p.PreserveFormatting = true
+	buf.Reset()
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# generated\nkey = value\nother = 1\n")
+}
+
+func TestClearCommentsWrite(t *testing.T) {
+	input := "# head\n! bang\nkey = value\n# description\nother = 1\n"
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	p.ClearComments()
+
+	buf := new(bytes.Buffer)
+	_, err = p.WriteComment(buf, "# ", UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "key = value\nother = 1\n")
+
+	assert.Equal(t, string(p.Bytes()), "key = value\nother = 1\n")
+}
+
+func TestStripComments(t *testing.T) {
+	input := "# head\nkey = value\n! description\nother = 1\n# tail\n"
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	p.StripComments()
+	assert.Equal(t, p.GetComments("key"), []string(nil))
+	assert.Equal(t, p.GetComments(""), []string(nil))
+
+	buf := new(bytes.Buffer)
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "key = value\nother = 1\n")
+}
+
 func TestFilter(t *testing.T) {
 	for _, test := range filterTests {
 		p := mustParse(t, test.input)
@@ -830,6 +1063,26 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestEntriesMatching(t *testing.T) {
+	p := mustParse(t, "db.port = 5\nweb.port = 80\ndb.host = ${web.port}\nname = n")
+	m, err := p.EntriesMatching(`\.port$|host`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, m, map[string]string{"db.port": "5", "web.port": "80", "db.host": "80"})
+
+	entries, err := p.EntriesMatchingOrdered(`^db\.`)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []Entry{{"db.port", "5"}, {"db.host", "80"}})
+
+	entries, err = p.EntriesMatchingOrdered("none")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []Entry{})
+
+	_, err = p.EntriesMatching("[")
+	assert.Matches(t, err.Error(), "missing closing ]")
+	_, err = p.EntriesMatchingOrdered("[")
+	assert.Matches(t, err.Error(), "missing closing ]")
+}
+
 func TestFilterPrefix(t *testing.T) {
 	for _, test := range filterPrefixTests {
 		p := mustParse(t, test.input)
@@ -871,6 +1124,29 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+func TestKeysPage(t *testing.T) {
+	p := mustParse(t, "a=1\nb=2\nc=3\nd=4\ne=5")
+	tests := []struct {
+		offset, limit int
+		keys          []string
+	}{
+		{0, 2, []string{"a", "b"}},
+		{2, 2, []string{"c", "d"}},
+		{4, 2, []string{"e"}},
+		{0, 10, []string{"a", "b", "c", "d", "e"}},
+		{5, 2, []string{}},
+		{10, 2, []string{}},
+		{1, 0, []string{}},
+		{1, -1, []string{}},
+		{-1, 1, []string{"a"}},
+	}
+	for _, test := range tests {
+		keys, total := p.KeysPage(test.offset, test.limit)
+		assert.Equal(t, keys, test.keys, fmt.Sprintf("offset=%d limit=%d", test.offset, test.limit))
+		assert.Equal(t, total, 5)
+	}
+}
+
 func TestSet(t *testing.T) {
 	for _, test := range setTests {
 		p := mustParse(t, test.input)
@@ -889,6 +1165,37 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestSetUnicodeLiterals(t *testing.T) {
+	p := NewProperties()
+	_, _, err := p.Set("key", "a\\u2318b")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("key"), "a\\u2318b")
+
+	for _, v := range []string{"a\\u12", "a\\u1", "a\\u123g", "\\u2318\\uabc"} {
+		_, _, err = p.Set("key", v)
+		assert.Equal(t, err.Error(), "invalid unicode literal", v)
+		assert.Equal(t, p.MustGet("key"), "a\\u2318b")
+	}
+
+	_, _, err = p.Set("k\\u12g", "value")
+	assert.Equal(t, err.Error(), "invalid unicode literal")
+	assert.Equal(t, p.Keys(), []string{"key"})
+
+	// a \u without hex digits is not a unicode literal
+	p.MustSet("dir", `C:\users\bob`)
+	assert.Equal(t, p.MustGet("dir"), `C:\users\bob`)
+	p, err = Marshal(struct{ Dir string }{`C:\users\bob`})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("Dir"), `C:\users\bob`)
+
+	// copies keep values which Set would reject
+	p = mustParse(t, "app.dir = C:\\\\users\\\\bob\napp.x = a\\\\u12\n")
+	assert.Equal(t, p.MustGet("app.x"), "a\\u12")
+	assert.Equal(t, p.FilterPrefix("app.").Keys(), []string{"app.dir", "app.x"})
+	assert.Equal(t, p.FilterStripPrefix("app.").MustGet("x"), "a\\u12")
+	assert.Equal(t, LoadMap(map[string]string{"x": "a\\u12"}).MustGet("x"), "a\\u12")
+}
+
 func TestSetValue(t *testing.T) {
 	tests := []interface{}{
 		true, false,
@@ -906,6 +1213,30 @@ func TestSetValue(t *testing.T) {
 	}
 }
 
+func TestOverrideFromMap(t *testing.T) {
+	p := mustParse(t, "a = 1\nb = 2")
+	err := p.OverrideFromMap(map[string]string{"b": "3", "c": "${b}"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"a", "b", "c"})
+	assert.Equal(t, p.MustGet("c"), "3")
+
+	// fail fast keeps the values set before the error
+	p = mustParse(t, "a = 1\nb = 2")
+	err = p.OverrideFromMap(map[string]string{"a": "x", "b": "${oops", "c": "z"})
+	assert.Equal(t, err.Error(), "properties: cannot set b: malformed expression")
+	assert.Equal(t, p.Map(), map[string]string{"a": "x", "b": "2"})
+
+	// the atomic version leaves the properties unchanged
+	p = mustParse(t, "a = 1\nb = 2")
+	err = p.OverrideFromMapAtomic(map[string]string{"a": "x", "b": "${oops", "c": "z"})
+	assert.Equal(t, err.Error(), "properties: cannot set b: malformed expression")
+	assert.Equal(t, p.Map(), map[string]string{"a": "1", "b": "2"})
+
+	err = p.OverrideFromMapAtomic(map[string]string{"a": "x", "c": "z"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Map(), map[string]string{"a": "x", "b": "2", "c": "z"})
+}
+
 func TestMustSet(t *testing.T) {
 	input := "key=${key}"
 	p := mustParse(t, input)
@@ -913,6 +1244,66 @@ func TestMustSet(t *testing.T) {
 	assert.Panic(t, func() { p.MustSet("key", "${key}") }, e)
 }
 
+func TestSelfRefFromEnv(t *testing.T) {
+	os.Setenv("_PROPS_SELF", "/bin:${x}")
+	defer os.Unsetenv("_PROPS_SELF")
+	os.Unsetenv("_PROPS_SELF_UNSET")
+
+	// self references are circular by default even if the env var exists
+	_, err := Load([]byte("_PROPS_SELF=${_PROPS_SELF}:/opt/bin"), UTF8)
+	assert.Matches(t, err.Error(), "circular reference")
+	_, err = Load([]byte("_PROPS_SELF_UNSET=${_PROPS_SELF_UNSET}:/opt/bin"), UTF8)
+	assert.Matches(t, err.Error(), "circular reference")
+
+	// the env var is used and not expanded further
+	l := &Loader{Encoding: UTF8, SelfRefFromEnv: true}
+	p, err := l.LoadBytes([]byte("_PROPS_SELF=${_PROPS_SELF}:${dir}\ndir=/opt/bin\nx=y"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("_PROPS_SELF"), "/bin:${x}:/opt/bin")
+
+	// indirect references are only resolved if all keys of the cycle exist
+	// as env vars since the expansion can start at any key of the cycle.
+	_, err = l.LoadBytes([]byte("_PROPS_SELF=${a}\na=${_PROPS_SELF}:a"))
+	assert.Matches(t, err.Error(), "circular reference")
+
+	// without the env var the reference is still circular
+	_, err = l.LoadBytes([]byte("_PROPS_SELF_UNSET=${_PROPS_SELF_UNSET}"))
+	assert.Matches(t, err.Error(), "circular reference")
+
+	_, _, err = p.Set("_PROPS_SELF_UNSET", "${_PROPS_SELF_UNSET}")
+	assert.Matches(t, err.Error(), "circular reference")
+	_, _, err = p.Set("_PROPS_SELF", "${_PROPS_SELF}:2")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("_PROPS_SELF"), "/bin:${x}:2")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	p := mustParse(t, "host = h\nurl = http://${host}")
+	swapped, err := p.CompareAndSwap("url", "http://${host}", "https://${host}")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, swapped, true)
+	assert.Equal(t, p.MustGet("url"), "https://h")
+
+	// the raw value is compared, not the expanded one
+	swapped, err = p.CompareAndSwap("url", "https://h", "x")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, swapped, false)
+	assert.Equal(t, p.MustGet("url"), "https://h")
+
+	swapped, err = p.CompareAndSwap("missing", "", "x")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, swapped, false)
+	assert.Equal(t, p.Len(), 2)
+
+	swapped, err = p.CompareAndSwap("host", "h", "${url")
+	assert.Matches(t, err.Error(), "malformed expression")
+	assert.Equal(t, swapped, false)
+	swapped, err = p.CompareAndSwap("host", "h", "${url}")
+	assert.Matches(t, err.Error(), "circular reference")
+	assert.Equal(t, swapped, false)
+	assert.Equal(t, p.MustGet("host"), "h")
+}
+
 func TestWrite(t *testing.T) {
 	for _, test := range writeTests {
 		p, err := parse(test.input)
@@ -932,6 +1323,110 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestSetEncoding(t *testing.T) {
+	p := mustParse(t, "iso = ä⌘\nutf = ä⌘\nother = ä⌘")
+	p.SetEncoding("iso", ISO_8859_1)
+	p.SetEncoding("utf", UTF8)
+
+	buf := new(bytes.Buffer)
+	_, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "iso = ä\\u2318\nutf = ä⌘\nother = ä⌘\n")
+
+	buf.Reset()
+	_, err = p.Write(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "iso = ä\\u2318\nutf = ä⌘\nother = ä\\u2318\n")
+
+	// the encoding is kept in copies and removed with the key
+	buf.Reset()
+	_, err = Merge(p).Write(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "iso = ä\\u2318\nutf = ä⌘\nother = ä\\u2318\n")
+	p.Delete("utf")
+	p.MustSet("utf", "⌘")
+	buf.Reset()
+	_, err = p.Write(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "iso = ä\\u2318\nother = ä\\u2318\nutf = \\u2318\n")
+}
+
+func TestSetValidator(t *testing.T) {
+	noSpaces := func(key, value string) error {
+		if strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("invalid key %q", key)
+		}
+		return nil
+	}
+
+	p := mustParse(t, "a = 1")
+	p.SetValidator(noSpaces)
+	_, _, err := p.Set("my key", "2")
+	assert.Equal(t, err.Error(), `invalid key "my key"`)
+	assert.Equal(t, p.Keys(), []string{"a"})
+	prev, ok, err := p.Set("my.key", "2")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, prev, "")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, p.MustGet("my.key"), "2")
+	assert.Equal(t, p.Validate(), nil)
+
+	// existing entries are only checked by Validate
+	p.SetValidator(nil)
+	p.MustSet("other key", "3")
+	p.SetValidator(noSpaces)
+	assert.Equal(t, p.Validate().Error(), `invalid key "other key"`)
+
+	l := &Loader{Encoding: UTF8, Validator: noSpaces}
+	_, err = l.LoadBytes([]byte("a = 1\nb\\ c = 2"))
+	assert.Equal(t, err.Error(), `invalid key "b c"`)
+	p, err = l.LoadBytes([]byte("a = 1"))
+	assert.Equal(t, err, nil)
+	_, _, err = p.Set("b c", "2")
+	assert.Equal(t, err.Error(), `invalid key "b c"`)
+}
+
+func TestWriteKeyOrder(t *testing.T) {
+	p := mustParse(t, "z = 1\na = 2\nm = 3")
+	p.MustSet("b", "4")
+	p.MustSet("a", "5")
+	p.MustSet("0", "6")
+
+	want := "z = 1\na = 5\nm = 3\nb = 4\n0 = 6\n"
+	for i := 0; i < 10; i++ {
+		buf := new(bytes.Buffer)
+		_, err := p.Write(buf, UTF8)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, buf.String(), want)
+		assert.Equal(t, p.String(), want)
+	}
+}
+
+func TestWriteSorted(t *testing.T) {
+	p := mustParse(t, "z = 1\nk\\:ey = ä⌘\na = ${z}\n#comment\nm = 3")
+	p.MustSet("b", "4")
+
+	keys := append([]string(nil), p.Keys()...)
+	sort.Strings(keys)
+	sorted := NewProperties()
+	sorted.DisableExpansion = true
+	for _, k := range keys {
+		sorted.MustSet(k, p.m[k])
+	}
+	buf := new(bytes.Buffer)
+	_, err := sorted.Write(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	want := buf.String()
+
+	buf.Reset()
+	n, err := p.WriteSorted(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, len(want))
+	assert.Equal(t, buf.String(), want)
+	assert.Equal(t, buf.String(), "a = ${z}\nb = 4\nk\\:ey = ä\\u2318\nm = 3\nz = 1\n")
+	assert.Equal(t, p.Keys(), []string{"z", "k:ey", "a", "m", "b"})
+}
+
 func TestWriteComment(t *testing.T) {
 	for _, test := range writeCommentTests {
 		p, err := parse(test.input)
@@ -951,10 +1446,400 @@ func TestWriteComment(t *testing.T) {
 	}
 }
 
+func TestWriteMultilineValues(t *testing.T) {
+	p := NewProperties()
+	p.MustSet("key", "line1\nline2")
+	p.MustSet("key2", "a\n  b")
+	p.MustSet("key3", "value")
+	p.MultilineValues = true
+
+	buf := new(bytes.Buffer)
+	n, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	s := buf.String()
+	assert.Equal(t, n, len(s))
+	assert.Equal(t, s, "key = line1\\n\\\n    line2\nkey2 = a\\n\\\n    \\  b\nkey3 = value\n")
+
+	pp := MustLoadString(s)
+	assert.Equal(t, pp.MustGet("key"), "line1\nline2")
+	assert.Equal(t, pp.MustGet("key2"), "a\n  b")
+	assert.Equal(t, pp.MustGet("key3"), "value")
+}
+
+func TestWriteNewline(t *testing.T) {
+	p := mustParse(t, "# comment\nkey = value\n# other\nkey2 = a")
+	p.MustSet("key3", "line1\nline2")
+	p.MultilineValues = true
+	p.Newline = "\r\n"
+
+	buf := new(bytes.Buffer)
+	n, err := p.WriteComment(buf, "# ", UTF8)
+	assert.Equal(t, err, nil)
+	s := buf.String()
+	assert.Equal(t, n, len(s))
+	assert.Equal(t, s, "# comment\r\nkey = value\r\n\r\n# other\r\nkey2 = a\r\nkey3 = line1\\n\\\r\n    line2\r\n")
+
+	pp := MustLoadString(s)
+	assert.Equal(t, pp.Map(), p.Map())
+}
+
+func TestWritePreserveCommentChars(t *testing.T) {
+	input := "# a\n! b\nkey = value\n!c\n#d\nkey2 = value2\n"
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+
+	buf := new(bytes.Buffer)
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# a\n! b\nkey = value\n\n! c\n# d\nkey2 = value2\n")
+
+	buf.Reset()
+	_, err = p.WriteComment(buf, "# ", UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# a\n! b\nkey = value\n\n! c\n# d\nkey2 = value2\n")
+
+	// programmatically set comments use the default prefix
+	p.SetComment("key2", "e")
+	buf.Reset()
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# a\n! b\nkey = value\n\n# e\nkey2 = value2\n")
+}
+
+func TestWriteTrailingComments(t *testing.T) {
+	for _, test := range []struct {
+		input, output string
+	}{
+		{"# a\nkey = value\n\n! b\n# c\n", "# a\nkey = value\n\n! b\n# c\n"},
+		{"# a\nkey = value\n\n! b\n# c", "# a\nkey = value\n\n! b\n# c\n"},
+		{"key = value\n! b\n", "key = value\n! b\n"},
+		{"key = value\r\n  \r\n! b\r\n", "key = value\n\n! b\n"},
+		{"# a\n", "# a\n"},
+	} {
+		l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+		p, err := l.LoadBytes([]byte(test.input))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, p.GetComments(""), []string(nil))
+
+		buf := new(bytes.Buffer)
+		_, err = p.Write(buf, UTF8)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, buf.String(), test.output, test.input)
+
+		// the comments are not stored for the empty key
+		p.SetComment("", "x")
+		buf.Reset()
+		_, err = p.Write(buf, UTF8)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, buf.String(), test.output, test.input)
+	}
+
+	// values set without comments only write the key line
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte("# a\nkey = value\n\n! b\n# c\n"))
+	assert.Equal(t, err, nil)
+	p.MustSet("key2", "value2")
+	buf := new(bytes.Buffer)
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# a\nkey = value\nkey2 = value2\n\n! b\n# c\n")
+
+	// the comments are kept for case insensitive keys
+	l = &Loader{Encoding: UTF8, PreserveFormatting: true, IgnoreCase: true}
+	p, err = l.LoadBytes([]byte("Key = x\n! tail\n"))
+	assert.Equal(t, err, nil)
+	buf.Reset()
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "Key = x\n! tail\n")
+
+	// StripComments removes them
+	p.StripComments()
+	buf.Reset()
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "Key = x\n")
+}
+
+func TestBytes(t *testing.T) {
+	input := "! header\nkey  :  value\n\n# c\nkey2=a \\\n    b\n"
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Dirty(), false)
+	assert.Equal(t, string(p.Bytes()), input)
+
+	// reading does not modify the properties
+	p.MustGet("key")
+	assert.Equal(t, p.Dirty(), false)
+	assert.Equal(t, string(p.Bytes()), input)
+
+	p.MustSet("key", "other")
+	assert.Equal(t, p.Dirty(), true)
+	assert.Equal(t, string(p.Bytes()), "! header\nkey = other\n\n# c\nkey2 = a b\n")
+
+	// without PreserveFormatting the input is not retained
+	p = MustLoadString(input)
+	assert.Equal(t, string(p.Bytes()), "key = value\nkey2 = a b\n")
+
+	p = MustLoadString(input)
+	p.Delete("key")
+	assert.Equal(t, p.Dirty(), true)
+}
+
+func TestRawText(t *testing.T) {
+	input := "a = v\\u00e4lue\\ with\\tescapes\nb = line1\\\n    line2\r\nc : \\\\path\\\\to\nd\ne = last"
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err := l.LoadBytes([]byte(input))
+	assert.Equal(t, err, nil)
+
+	tests := []struct {
+		key, raw, value string
+	}{
+		{"a", `v\u00e4lue\ with\tescapes`, "välue with\tescapes"},
+		{"b", "line1\\\n    line2", "line1line2"},
+		{"c", `\\path\\to`, `\path\to`},
+		{"d", "", ""},
+		{"e", "last", "last"},
+	}
+	for _, test := range tests {
+		raw, ok := p.RawText(test.key)
+		assert.Equal(t, ok, true)
+		assert.Equal(t, raw, test.raw, test.key)
+		assert.Equal(t, p.MustGet(test.key), test.value, test.key)
+	}
+
+	// modified values are encoded
+	p.MustSet("a", "new\tvalue")
+	raw, _ := p.RawText("a")
+	assert.Equal(t, raw, `new\tvalue`)
+	_, ok := p.RawText("missing")
+	assert.Equal(t, ok, false)
+
+	// quoted values include the quotes
+	l.RespectQuotes = true
+	p, err = l.LoadBytes([]byte(`q = "  \"x\"  "   `))
+	assert.Equal(t, err, nil)
+	raw, _ = p.RawText("q")
+	assert.Equal(t, raw, `"  \"x\"  "`)
+
+	// without PreserveFormatting the values are encoded
+	p = mustParse(t, input)
+	raw, _ = p.RawText("a")
+	assert.Equal(t, raw, "välue with\\tescapes")
+}
+
+func TestWriteEscapeNonASCII(t *testing.T) {
+	p := NewProperties()
+	p.MustSet("key⌘", "valueä⌘")
+	p.EscapeNonASCII = true
+
+	buf := new(bytes.Buffer)
+	n, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, buf.Len())
+	assert.Equal(t, buf.String(), "key\\u2318 = value\\u00e4\\u2318\n")
+
+	pp := MustLoadString(buf.String())
+	assert.Equal(t, pp.MustGet("key⌘"), "valueä⌘")
+}
+
+func TestWriteKeyEscaping(t *testing.T) {
+	tests := []struct {
+		key, output string
+	}{
+		{" ", "\\  = value\n"},
+		{"=", "\\= = value\n"},
+		{":", "\\: = value\n"},
+		{"a ", "a\\  = value\n"},
+		{" a", "\\ a = value\n"},
+		{"a=b", "a\\=b = value\n"},
+		{"a:b c", "a\\:b\\ c = value\n"},
+		{"\ta", "\\ta = value\n"},
+		{"#a", "\\#a = value\n"},
+		{"!a", "\\!a = value\n"},
+	}
+	for _, test := range tests {
+		p := NewProperties()
+		p.MustSet(test.key, "value")
+		buf := new(bytes.Buffer)
+		_, err := p.Write(buf, UTF8)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, buf.String(), test.output)
+
+		pp := MustLoadString(buf.String())
+		assert.Equal(t, pp.Keys(), []string{test.key}, fmt.Sprintf("%q", test.key))
+		assert.Equal(t, pp.MustGet(test.key), "value")
+	}
+}
+
+func TestWriteDescriptionSuffix(t *testing.T) {
+	p := mustParse(t, "db.host = h\ndb.host.desc = Database host\n# port\ndb.port = 5432\ndb.port.desc = Database port\\nDefault 5432\norphan.desc = kept\nname = n")
+	p.DescriptionSuffix = ".desc"
+
+	buf := new(bytes.Buffer)
+	_, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "# Database host\ndb.host = h\n\n# Database port\n# Default 5432\ndb.port = 5432\norphan.desc = kept\nname = n\n")
+
+	buf.Reset()
+	_, err = p.WriteComment(buf, "## ", UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "## Database host\ndb.host = h\n\n## port\n## Database port\n## Default 5432\ndb.port = 5432\norphan.desc = kept\nname = n\n")
+
+	// the description keys are still available
+	assert.Equal(t, p.MustGet("db.host.desc"), "Database host")
+}
+
+func TestWriteAlignValues(t *testing.T) {
+	p := NewProperties()
+	p.MustSet("a", "1")
+	p.MustSet("long.key", "2")
+	p.MustSet("k y", "3")
+	p.MustSet("k⌘", "4")
+	p.AlignValues = true
+
+	buf := new(bytes.Buffer)
+	n, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, buf.Len())
+	assert.Equal(t, buf.String(), "a        = 1\nlong.key = 2\nk\\ y     = 3\nk⌘       = 4\n")
+
+	pp := MustLoadString(buf.String())
+	assert.Equal(t, pp.Map(), p.Map())
+
+	p.WriteSeparator = "="
+	buf.Reset()
+	_, err = p.Write(buf, ISO_8859_1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "a       =1\nlong.key=2\nk\\ y    =3\nk\\u2318 =4\n")
+}
+
+func TestWriteSeparator(t *testing.T) {
+	p := mustParse(t, "key = value\nk\\:ey = v:a=l")
+	for _, test := range []struct {
+		sep, out string
+	}{
+		{"", "key = value\nk\\:ey = v:a=l\n"},
+		{"=", "key=value\nk\\:ey=v:a=l\n"},
+		{": ", "key: value\nk\\:ey: v:a=l\n"},
+		{"\t", "key\tvalue\nk\\:ey\tv:a=l\n"},
+	} {
+		p.WriteSeparator = test.sep
+		buf := new(bytes.Buffer)
+		_, err := p.Write(buf, UTF8)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, buf.String(), test.out)
+		assert.Equal(t, MustLoadString(buf.String()).Map(), p.Map())
+	}
+
+	for _, sep := range []string{"->", "==", " = : ", "x", "\n"} {
+		p.WriteSeparator = sep
+		n, err := p.Write(new(bytes.Buffer), UTF8)
+		assert.Equal(t, n, 0)
+		assert.Equal(t, err.Error(), fmt.Sprintf("properties: invalid separator %q", sep))
+		assert.Panic(t, func() { p.Bytes() }, "invalid separator")
+	}
+
+	// the custom delimiter of the loader is accepted
+	l := &Loader{Encoding: UTF8, Delimiter: "=>"}
+	p, err := l.LoadBytes([]byte("key => value\nk\\:ey => v:a=l"))
+	assert.Equal(t, err, nil)
+	p.WriteSeparator = " => "
+	buf := new(bytes.Buffer)
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "key => value\nk\\:ey => v:a=l\n")
+	pp, err := l.LoadBytes(buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pp.Map(), p.Map())
+	p.Delimiter = ""
+	_, err = p.Write(buf, UTF8)
+	assert.Equal(t, err.Error(), `properties: invalid separator " => "`)
+}
+
 func TestCustomExpansionExpression(t *testing.T) {
 	testKeyValuePrePostfix(t, "*[", "]*", "key=value\nkey2=*[key]*", "key", "value", "key2", "value")
 }
 
+func TestEscapedExpansionExpression(t *testing.T) {
+	testKeyValuePrePostfix(t, "#[", "]#", "key=value\nkey2=\\\\#[key]# is #[key]#\nkey3=#[key2]#", "key", "value", "key2", "#[key]# is value", "key3", "#[key]# is value")
+	testKeyValuePrePostfix(t, "${", "}", "key=value\nkey2=\\\\${key} ${key}", "key", "value", "key2", "${key} value")
+
+	p := NewProperties()
+	p.Prefix, p.Postfix = "#[", "]#"
+	p.MustSet("key", "value")
+	p.MustSet("lit", `\#[key]#`)
+	p.MustSet("ref", "#[lit]#]#")
+	p.MustSet("missing", `\#[key`)
+	assert.Equal(t, p.MustGet("lit"), "#[key]#")
+	assert.Equal(t, p.MustGet("ref"), "#[key]#]#")
+	assert.Equal(t, p.MustGet("missing"), "#[key")
+	assert.Equal(t, p.UnresolvedRefs(), []string(nil))
+}
+
+func TestExpansionFallback(t *testing.T) {
+	if err := os.Setenv("_FALLBACK_ENV", "env"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("_FALLBACK_ENV")
+
+	input := `
+	a = value
+	b = ${a:-fallback}
+	c = ${missing:-fallback}
+	d = ${missing:-${a}/x}
+	e = ${missing:-${other:-deep}}
+	f = ${_FALLBACK_ENV:-fallback}
+	g = ${missing:-}
+	h = x:-y
+	i = ${missing:-\\${a}}
+	j = ${missing:-${unknown}}
+	`
+	p := mustParse(t, input)
+	assert.Equal(t, p.MustGet("b"), "value")
+	assert.Equal(t, p.MustGet("c"), "fallback")
+	assert.Equal(t, p.MustGet("d"), "value/x")
+	assert.Equal(t, p.MustGet("e"), "deep")
+	assert.Equal(t, p.MustGet("f"), "env")
+	assert.Equal(t, p.MustGet("g"), "")
+	assert.Equal(t, p.MustGet("h"), "x:-y")
+	assert.Equal(t, p.MustGet("i"), "${a}")
+	assert.Equal(t, p.MustGet("j"), "")
+	assert.Equal(t, p.UnresolvedRefs(), []string{"unknown"})
+
+	// fallback values cannot hide circular references or malformed expressions
+	for _, input := range []string{
+		"a = ${a:-x}",
+		"a = ${b:-x}\nb = ${a}",
+		"a = ${missing:-x",
+		"a = ${missing:-${b}",
+	} {
+		_, err := LoadString(input)
+		assert.Equal(t, err != nil, true, input)
+	}
+}
+
+func TestDoubledPrefixEscape(t *testing.T) {
+	testKeyValuePrePostfix(t, "${", "}", "key=value\nkey2=$${not_a_ref} ${key}", "key", "value", "key2", "${not_a_ref} value")
+	testKeyValuePrePostfix(t, "#[", "]#", "key=value\nkey2=##[key]# is #[key]#", "key", "value", "key2", "#[key]# is value")
+
+	input := "a = $${not_a_ref}\nb = cost: $$${a}\n"
+	p := mustParse(t, input)
+	assert.Equal(t, p.MustGet("a"), "${not_a_ref}")
+	assert.Equal(t, p.MustGet("b"), "cost: $${a}")
+	assert.Equal(t, p.UnresolvedRefs(), []string(nil))
+
+	// the escaped form is written and loaded unchanged
+	buf := new(bytes.Buffer)
+	_, err := p.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), input)
+	p = mustParse(t, buf.String())
+	assert.Equal(t, p.MustGet("a"), "${not_a_ref}")
+}
+
 func TestPanicOn32BitIntOverflow(t *testing.T) {
 	is32Bit = true
 	var min, max int64 = math.MinInt32 - 1, math.MaxInt32 + 1
@@ -1001,6 +1886,25 @@ func TestDeleteUnknownKey(t *testing.T) {
 	assert.Equal(t, len(p.k), 1)
 }
 
+func TestPop(t *testing.T) {
+	p := mustParse(t, "#comment\nkey=value\nsecond=${key}2\nthird=3")
+	v, ok := p.Pop("second")
+	assert.Equal(t, v, "value2")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.Keys(), []string{"key", "third"})
+
+	v, ok = p.Pop("key")
+	assert.Equal(t, v, "value")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, len(p.c), 0)
+	assert.Equal(t, p.String(), "third = 3\n")
+
+	v, ok = p.Pop("missing")
+	assert.Equal(t, v, "")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, p.Keys(), []string{"third"})
+}
+
 func TestMerge(t *testing.T) {
 	input1 := "#comment\nkey=value\nkey2=value2"
 	input2 := "#another comment\nkey=another value\nkey3=value3"
@@ -1014,6 +1918,146 @@ func TestMerge(t *testing.T) {
 	assert.Equal(t, p1.GetComment("key"), "another comment")
 }
 
+func TestMergeAll(t *testing.T) {
+	p1 := mustParse(t, "#c1\na=1\nb=1")
+	p2 := mustParse(t, "#c2\nb=2\nc=2")
+	p3 := mustParse(t, "c=3\nd=${a}3")
+	p := Merge(p1, nil, p2, p3)
+	assert.Equal(t, p.Keys(), []string{"a", "b", "c", "d"})
+	assert.Equal(t, p.Map(), map[string]string{"a": "1", "b": "2", "c": "3", "d": "${a}3"})
+	assert.Equal(t, p.MustGet("d"), "13")
+	assert.Equal(t, p.GetComment("a"), "c1")
+	assert.Equal(t, p.GetComment("b"), "c2")
+
+	// the inputs are not modified
+	assert.Equal(t, p1.Map(), map[string]string{"a": "1", "b": "1"})
+	assert.Equal(t, p2.Keys(), []string{"b", "c"})
+
+	assert.Equal(t, Merge().Len(), 0)
+	assert.Equal(t, Merge(nil).Len(), 0)
+}
+
+func TestAsEnviron(t *testing.T) {
+	p := mustParse(t, "db.host=h\ndb.url=http://${db.host}\nlog-level = debug")
+	assert.Equal(t, p.AsEnviron("PREFIX"), []string{"PREFIX_DB_HOST=h", "PREFIX_DB_URL=http://h", "PREFIX_LOG-LEVEL=debug"})
+	assert.Equal(t, p.AsEnviron("PREFIX_"), []string{"PREFIX_DB_HOST=h", "PREFIX_DB_URL=http://h", "PREFIX_LOG-LEVEL=debug"})
+	assert.Equal(t, p.AsEnviron(""), []string{"DB_HOST=h", "DB_URL=http://h", "LOG-LEVEL=debug"})
+	assert.Equal(t, NewProperties().AsEnviron("X"), []string{})
+}
+
+func TestTrackAccess(t *testing.T) {
+	p := mustParse(t, "a=1\nb=2\nc=${a}\nd=4\ne=5")
+	p.TrackAccess = true
+	assert.Equal(t, p.Unused(), []string{"a", "b", "c", "d", "e"})
+
+	p.MustGet("c")
+	p.GetInt("d", 0)
+	p.Touch("b")
+	p.MustSet("e", "6")
+	assert.Equal(t, p.Unused(), []string{"a", "e"})
+
+	// reads without TrackAccess are not recorded
+	p.TrackAccess = false
+	p.MustGet("a")
+	assert.Equal(t, p.Unused(), []string{"a", "e"})
+	p.Touch("a")
+	assert.Equal(t, p.Unused(), []string{"e"})
+
+	// functions which read many keys do not record them
+	p = mustParse(t, "a=1\nb=${a}\nc=3")
+	p.TrackAccess = true
+	_ = p.String()
+	p.AsEnviron("")
+	p.ToQuery()
+	p.GetMany("a", "b")
+	p.GetSliceMap("", ",")
+	p.ForEachPrefix("", func(k, v string) bool { return true })
+	p.SumInt("")
+	_, err := p.MarshalJSONWithMeta()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Unused(), []string{"a", "b", "c"})
+	p.MustGet("b")
+	assert.Equal(t, p.Unused(), []string{"a", "c"})
+
+	// concurrent readers
+	p = mustParse(t, "a=1\nb=2\nc=3")
+	p.TrackAccess = true
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.MustGet(key)
+			}
+		}(key)
+	}
+	wg.Wait()
+	assert.Equal(t, p.Unused(), []string{"c"})
+}
+
+func TestMarshalJSONWithMeta(t *testing.T) {
+	p := mustParse(t, "# the host\nhost = h\nurl = http://${host}\n# first\n# second\nq = \"x\"")
+	b, err := p.MarshalJSONWithMeta()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(b), `{"host":{"value":"h","comment":"the host"},"url":{"value":"http://h"},"q":{"value":"\"x\"","comment":"first\nsecond"}}`)
+
+	b, err = NewProperties().MarshalJSONWithMeta()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(b), "{}")
+}
+
+func TestRenameAll(t *testing.T) {
+	p := mustParse(t, "# ca\na = 1\nb = ${a}\n# cc\nc = 3\nd = 4")
+	err := p.RenameAll(map[string]string{"a": "x", "c": "d", "d": "c"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"x", "b", "d", "c"})
+	assert.Equal(t, p.Map(), map[string]string{"x": "1", "b": "${a}", "d": "3", "c": "4"})
+	assert.Equal(t, p.GetComment("x"), "ca")
+	assert.Equal(t, p.GetComment("d"), "cc")
+	assert.Equal(t, p.GetComment("c"), "")
+
+	tests := []struct {
+		mapping map[string]string
+		err     string
+	}{
+		{map[string]string{"x": "b"}, "cannot rename x to b: key exists"},
+		{map[string]string{"x": "y", "b": "y"}, "cannot rename b and x to y"},
+		{map[string]string{"missing": "y"}, "unknown property: missing"},
+		{map[string]string{"x": ""}, "cannot rename x to an empty key"},
+	}
+	for _, test := range tests {
+		err := p.RenameAll(test.mapping)
+		assert.Matches(t, err.Error(), test.err)
+		assert.Equal(t, p.Keys(), []string{"x", "b", "d", "c"})
+		assert.Equal(t, p.Map(), map[string]string{"x": "1", "b": "${a}", "d": "3", "c": "4"})
+	}
+
+	// renames which introduce a circular reference are rejected
+	p = mustParse(t, "a = ${b}\nc = 1")
+	err = p.RenameAll(map[string]string{"c": "b"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.MustGet("a"), "1")
+	err = p.RenameAll(map[string]string{"b": "a", "a": "b"})
+	assert.Matches(t, err.Error(), "circular reference")
+	assert.Equal(t, p.Keys(), []string{"a", "b"})
+	assert.Equal(t, p.Map(), map[string]string{"a": "${b}", "b": "1"})
+
+	// encodings and raw texts move with the key
+	l := &Loader{Encoding: UTF8, PreserveFormatting: true}
+	p, err = l.LoadBytes([]byte("a = v\\u2318\nb = 2"))
+	assert.Equal(t, err, nil)
+	p.SetEncoding("a", ISO_8859_1)
+	assert.Equal(t, p.RenameAll(map[string]string{"a": "x"}), nil)
+	raw, _ := p.RawText("x")
+	assert.Equal(t, raw, `v\u2318`)
+	p.MustSet("a", "⌘")
+	var buf bytes.Buffer
+	_, err = p.Write(&buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "x = v\\u2318\nb = 2\na = ⌘\n")
+}
+
 func TestMap(t *testing.T) {
 	input := "key=value\nabc=def"
 	p := mustParse(t, input)
@@ -1039,6 +2083,547 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, err, nil)
 }
 
+func TestUnresolvedRefs(t *testing.T) {
+	if err := os.Setenv("_UNRESOLVED_ENV", "x"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("_UNRESOLVED_ENV")
+
+	input := "a=value\nb=${a}\nc=${missing}/${_UNRESOLVED_ENV}\nd=${missing}${other}"
+	p := mustParse(t, input)
+	assert.Equal(t, p.UnresolvedRefs(), []string{"missing", "other"})
+
+	p = mustParse(t, "a=value\nb=${a}")
+	assert.Equal(t, p.UnresolvedRefs(), ([]string)(nil))
+}
+
+func TestGetConcat(t *testing.T) {
+	p := mustParse(t, "msg.3 = !\nmsg.1 = Hello\\ \nmsg.2 = World\nother = x")
+	assert.Equal(t, p.GetConcat("msg."), "Hello World!")
+	assert.Equal(t, p.MustGetConcat("msg."), "Hello World!")
+	assert.Equal(t, p.GetConcat("none."), "")
+
+	// gap at msg.2
+	p = mustParse(t, "msg.1 = Hello\\ \nmsg.3 = World")
+	assert.Equal(t, p.GetConcat("msg."), "Hello World")
+	assert.Panic(t, func() { p.MustGetConcat("msg.") }, "missing key msg.2")
+
+	// non-numeric suffix
+	p = mustParse(t, "msg.1 = Hello\nmsg.x = World")
+	assert.Equal(t, p.GetConcat("msg."), "Hello")
+	assert.Panic(t, func() { p.MustGetConcat("msg.") }, "non-numeric suffix in key msg.x")
+
+	// numbers which are not in canonical form
+	for _, key := range []string{"msg.01", "msg.+2", "msg.-0"} {
+		p = mustParse(t, "msg.1 = Hello\nmsg.2 = World\n"+key+" = !")
+		assert.Equal(t, p.GetConcat("msg."), "HelloWorld")
+		assert.Panic(t, func() { p.MustGetConcat("msg.") }, "non-numeric suffix in key "+regexp.QuoteMeta(key))
+	}
+}
+
+func TestDeprecate(t *testing.T) {
+	var logs []string
+	defer func(f LogHandlerFunc) { LogPrintf = f }(LogPrintf)
+	LogPrintf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	p := mustParse(t, "db.hostname = new\ndb.server = old")
+	p.Deprecate("db.server", "db.hostname")
+	assert.Equal(t, p.MustGet("db.server"), "new")
+	assert.Equal(t, p.MustGet("db.server"), "new")
+	assert.Equal(t, logs, []string{"properties: db.server is deprecated, use db.hostname"})
+
+	// old key is still used when the new key does not exist
+	logs = nil
+	p = mustParse(t, "db.server = old")
+	p.Deprecate("db.server", "db.hostname")
+	assert.Equal(t, p.MustGet("db.server"), "old")
+	assert.Equal(t, len(logs), 1)
+}
+
+func TestGetMapped(t *testing.T) {
+	m := map[string]int{"little": 1, "big": 2}
+	p := mustParse(t, "a = little\nb = BIG\nc = middle")
+	assert.Equal(t, p.GetMapped("a", m, 0), 1)
+	assert.Equal(t, p.GetMapped("b", m, 0), 2)
+	assert.Equal(t, p.GetMapped("c", m, 0), 0)
+	assert.Equal(t, p.GetMapped("d", m, 0), 0)
+	assert.Equal(t, p.MustGetMapped("a", m), 1)
+	assert.Panic(t, func() { p.MustGetMapped("c", m) }, `unmapped value "middle" for key c`)
+	assert.Panic(t, func() { p.MustGetMapped("d", m) }, "unknown property: d")
+
+	// exact matches win over case-insensitive ones
+	m = map[string]int{"Big": 1, "big": 2}
+	p = mustParse(t, "a = Big\nb = big\nc = BIG")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, p.GetMapped("a", m, 0), 1)
+		assert.Equal(t, p.GetMapped("b", m, 0), 2)
+		assert.Equal(t, p.GetMapped("c", m, 0), 1)
+	}
+}
+
+func TestCount(t *testing.T) {
+	p := mustParse(t, "db.host = h\ndb.port = 5\nweb.port = 80\ndbx = y")
+	assert.Equal(t, p.CountPrefix("db."), 2)
+	assert.Equal(t, p.CountPrefix("db"), 3)
+	assert.Equal(t, p.CountPrefix(""), 4)
+	assert.Equal(t, p.CountPrefix("none"), 0)
+	assert.Equal(t, p.CountFunc(func(k, v string) bool { return strings.HasSuffix(k, ".port") }), 2)
+	assert.Equal(t, p.CountFunc(func(k, v string) bool { return v == "y" }), 1)
+}
+
+func TestForEachPrefix(t *testing.T) {
+	p := mustParse(t, "db.port = 5\nweb.port = 80\ndb.host = ${web.port}\ndb.user = u")
+	var got []string
+	p.ForEachPrefix("db.", func(k, v string) bool {
+		got = append(got, k+"="+v)
+		return true
+	})
+	assert.Equal(t, got, []string{"db.port=5", "db.host=80", "db.user=u"})
+
+	got = nil
+	p.ForEachPrefix("db.", func(k, v string) bool {
+		got = append(got, k)
+		return len(got) < 2
+	})
+	assert.Equal(t, got, []string{"db.port", "db.host"})
+
+	got = nil
+	p.ForEachPrefix("none", func(k, v string) bool {
+		got = append(got, k)
+		return true
+	})
+	assert.Equal(t, got, []string(nil))
+}
+
+func TestSum(t *testing.T) {
+	p := mustParse(t, "w.a=1\nw.b=2\nw.c=3\nx=4\nf.a=0.5\nf.b=1.25\nbad.a=1\nbad.b=x")
+	n, err := p.SumInt("w.")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(6))
+	n, err = p.SumInt("none")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, int64(0))
+	_, err = p.SumInt("bad.")
+	assert.Matches(t, err.Error(), "invalid integer for key bad.b")
+	_, err = p.SumInt("f.")
+	assert.Matches(t, err.Error(), "invalid integer for key f.a")
+
+	f, err := p.SumFloat64("f.")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, f, 1.75)
+	f, err = p.SumFloat64("w.")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, f, 6.0)
+	_, err = p.SumFloat64("bad.")
+	assert.Matches(t, err.Error(), "invalid number for key bad.b")
+}
+
+func TestGetOneOf(t *testing.T) {
+	options := []string{"debug", "info", "warn"}
+	p := mustParse(t, "a = info\nb = INFO")
+	v, err := p.GetOneOf("a", options)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, v, "info")
+
+	v, err = p.GetOneOf("b", options)
+	assert.Equal(t, v, "")
+	assert.Equal(t, err.Error(), `invalid value "INFO" for key b. must be one of [debug, info, warn]`)
+
+	v, err = p.GetOneOf("c", options)
+	assert.Equal(t, v, "")
+	assert.Equal(t, err.Error(), "unknown property: c")
+}
+
+func TestApply(t *testing.T) {
+	p := mustParse(t, "a = foo\nb = ${a}bar")
+	err := p.Apply(func(k, v string) (string, error) {
+		return strings.ToUpper(v), nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.Keys(), []string{"a", "b"})
+	assert.Equal(t, p.Map(), map[string]string{"a": "FOO", "b": "${A}BAR"})
+
+	p = mustParse(t, "a = foo\nb = bar")
+	err = p.Apply(func(k, v string) (string, error) {
+		if k == "b" {
+			return "", fmt.Errorf("boom")
+		}
+		return strings.ToUpper(v), nil
+	})
+	assert.Equal(t, err.Error(), "boom")
+	assert.Equal(t, p.Map(), map[string]string{"a": "foo", "b": "bar"})
+
+	// malformed expressions roll back
+	err = p.Apply(func(k, v string) (string, error) { return v + "${", nil })
+	assert.Equal(t, err.Error(), "malformed expression")
+	assert.Equal(t, p.Map(), map[string]string{"a": "foo", "b": "bar"})
+}
+
+func TestGetThreshold(t *testing.T) {
+	tests := []struct {
+		input, key string
+		op         string
+		value      float64
+		ok         bool
+	}{
+		{"key = >80", "key", ">", 80, true},
+		{"key = >= 0.5", "key", ">=", 0.5, true},
+		{"key = == 3", "key", "==", 3, true},
+		{"key = <-1", "key", "<", -1, true},
+		{"key = <= 1e3", "key", "<=", 1000, true},
+		{"key = 80", "key", "", 0, false},
+		{"key = > abc", "key", "", 0, false},
+		{"key = => 3", "key", "", 0, false},
+		{"key = >80", "key2", "", 0, false},
+	}
+	for _, test := range tests {
+		p := mustParse(t, test.input)
+		op, value, ok := p.GetThreshold(test.key)
+		assert.Equal(t, op, test.op, test.input)
+		assert.Equal(t, value, test.value, test.input)
+		assert.Equal(t, ok, test.ok, test.input)
+	}
+}
+
+func TestMustGetThreshold(t *testing.T) {
+	p := mustParse(t, "key = > 80\nkey2 = 80\nkey3 = > x")
+	op, value := p.MustGetThreshold("key")
+	assert.Equal(t, op, ">")
+	assert.Equal(t, value, float64(80))
+	assert.Panic(t, func() { p.MustGetThreshold("key2") }, "missing operator in threshold \"80\" for key key2")
+	assert.Panic(t, func() { p.MustGetThreshold("key3") }, "strconv.ParseFloat: parsing.*")
+	assert.Panic(t, func() { p.MustGetThreshold("invalid") }, "unknown property: invalid")
+}
+
+func TestGetMany(t *testing.T) {
+	p := mustParse(t, "host = h\nport = 5\nurl = ${host}:${port}")
+	assert.Equal(t, p.GetMany("host", "url", "user"), map[string]string{"host": "h", "url": "h:5"})
+	assert.Equal(t, p.GetMany(), map[string]string{})
+	assert.Equal(t, p.MustGetMany("host", "port"), map[string]string{"host": "h", "port": "5"})
+	assert.Panic(t, func() { p.MustGetMany("host", "user") }, "unknown property: user")
+}
+
+func TestRequireAll(t *testing.T) {
+	p := mustParse(t, "host = h\nport = 5\nbroken = ${x")
+	assert.Equal(t, p.RequireAll("host", "port", "broken"), nil)
+	assert.Equal(t, p.RequireAll(), nil)
+	assert.Equal(t, p.RequireAll("user", "host", "password").Error(), "missing properties: user, password")
+}
+
+func TestActivateProfile(t *testing.T) {
+	input := "db.host = localhost\ndb.host@prod = prod.example.com\ndb.host@dev = dev.example.com\ndb.user@prod = admin\ndb.port = 5432"
+	p := mustParse(t, input)
+	assert.Equal(t, p.ActivateProfile("prod"), nil)
+	assert.Equal(t, p.Keys(), []string{"db.host", "db.port", "db.user"})
+	assertKeyValues(t, input, p, "db.host", "prod.example.com", "db.port", "5432", "db.user", "admin")
+
+	p = mustParse(t, input)
+	assert.Equal(t, p.ActivateProfile("test"), nil)
+	assert.Equal(t, p.Keys(), []string{"db.host", "db.port"})
+	assertKeyValues(t, input, p, "db.host", "localhost", "db.port", "5432")
+
+	p = mustParse(t, "a = ${b}\nb = x\nb@prod = ${a}")
+	assert.Matches(t, p.ActivateProfile("prod").Error(), "circular reference")
+	assert.Equal(t, p.Keys(), []string{"a", "b", "b@prod"})
+	assert.Equal(t, p.MustGet("a"), "x")
+
+	p = mustParse(t, "admin@example.com = x\nmail = a\nmail@prod = b")
+	assert.Equal(t, p.ActivateProfile("prod"), nil)
+	assert.Equal(t, p.Keys(), []string{"admin@example.com", "mail"})
+	assert.Equal(t, p.MustGet("admin@example.com"), "x")
+	assert.Equal(t, p.MustGet("mail"), "b")
+}
+
+func TestGetCIDR(t *testing.T) {
+	p := mustParse(t, "allow = 10.0.0.0/8\nv6 = fd00::/8\nhost = 192.168.1.7/24\nbad = 10.0.0.0/33\nlist = 10.0.0.0/8, 192.168.0.0/16\nbadlist = 10.0.0.0/8,x")
+	n, ok := p.GetCIDR("allow")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, n.String(), "10.0.0.0/8")
+	assert.Equal(t, n.Contains(net.ParseIP("10.1.2.3")), true)
+	n, ok = p.GetCIDR("v6")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, n.String(), "fd00::/8")
+	n, ok = p.GetCIDR("host")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, n.String(), "192.168.1.0/24")
+
+	_, ok = p.GetCIDR("bad")
+	assert.Equal(t, ok, false)
+	_, ok = p.GetCIDR("missing")
+	assert.Equal(t, ok, false)
+
+	assert.Equal(t, p.MustGetCIDR("allow").String(), "10.0.0.0/8")
+	assert.Panic(t, func() { p.MustGetCIDR("bad") }, "invalid CIDR address")
+	assert.Panic(t, func() { p.MustGetCIDR("missing") }, "unknown property: missing")
+
+	list, ok := p.GetCIDRList("list")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, len(list), 2)
+	assert.Equal(t, list[1].String(), "192.168.0.0/16")
+	_, ok = p.GetCIDRList("badlist")
+	assert.Equal(t, ok, false)
+	_, ok = p.GetCIDRList("missing")
+	assert.Equal(t, ok, false)
+}
+
+func TestGetUUID(t *testing.T) {
+	p := mustParse(t, "a = 550e8400-e29b-41d4-a716-446655440000\nb = 550E8400-E29B-41D4-A716-446655440000\nc = 550e8400-e29b-41d4-a716-44665544000\nd = 550e8400e29b41d4a716446655440000")
+	assert.Equal(t, p.GetUUID("a", "def"), "550e8400-e29b-41d4-a716-446655440000")
+	assert.Equal(t, p.GetUUID("b", "def"), "550E8400-E29B-41D4-A716-446655440000")
+	assert.Equal(t, p.GetUUID("c", "def"), "def")
+	assert.Equal(t, p.GetUUID("d", "def"), "def")
+	assert.Equal(t, p.GetUUID("e", "def"), "def")
+	assert.Equal(t, p.MustGetUUID("a"), "550e8400-e29b-41d4-a716-446655440000")
+	assert.Panic(t, func() { p.MustGetUUID("c") }, `invalid UUID "550e8400-e29b-41d4-a716-44665544000" for key c`)
+	assert.Panic(t, func() { p.MustGetUUID("e") }, "unknown property: e")
+}
+
+func TestSorted(t *testing.T) {
+	p := mustParse(t, "# comment c\nc = 3\na = ${c}\nb = 2")
+	p.WriteSeparator = "="
+	pp := p.Sorted()
+	assert.Equal(t, pp.Keys(), []string{"a", "b", "c"})
+	assert.Equal(t, pp.MustGet("a"), "3")
+	assert.Equal(t, pp.GetComment("c"), "comment c")
+	assert.Equal(t, pp.WriteSeparator, "=")
+	assert.Equal(t, pp.String(), "a = 3\nb = 2\nc = 3\n")
+
+	// the original is unchanged
+	assert.Equal(t, p.Keys(), []string{"c", "a", "b"})
+	pp.MustSet("d", "4")
+	pp.SetComment("c", "changed")
+	assert.Equal(t, p.Len(), 3)
+	assert.Equal(t, p.GetComment("c"), "comment c")
+}
+
+func TestGetStringEnv(t *testing.T) {
+	os.Unsetenv("_GETSTRINGENV")
+	p := mustParse(t, "db.host = h")
+	assert.Equal(t, p.GetStringEnv("db.host", "_GETSTRINGENV", "def"), "h")
+	assert.Equal(t, p.GetStringEnv("db.user", "_GETSTRINGENV", "def"), "def")
+	assert.Panic(t, func() { p.MustGetStringEnv("db.user", "_GETSTRINGENV") }, "unknown property: db.user and environment variable _GETSTRINGENV is not set")
+
+	os.Setenv("_GETSTRINGENV", "env")
+	defer os.Unsetenv("_GETSTRINGENV")
+	assert.Equal(t, p.GetStringEnv("db.host", "_GETSTRINGENV", "def"), "h")
+	assert.Equal(t, p.GetStringEnv("db.user", "_GETSTRINGENV", "def"), "env")
+	assert.Equal(t, p.MustGetStringEnv("db.host", "_GETSTRINGENV"), "h")
+	assert.Equal(t, p.MustGetStringEnv("db.user", "_GETSTRINGENV"), "env")
+}
+
+func TestRedacted(t *testing.T) {
+	p := mustParse(t, "db.user = admin\ndb.password = secret\ndb.url = ${db.user}:${db.password}@host\nldap.password = ${db.password}")
+	pp := p.Redacted(func(k string) bool { return strings.Contains(k, "password") })
+	assert.Equal(t, pp.Keys(), p.Keys())
+	assert.Equal(t, pp.String(), "db.user = admin\ndb.password = ***\ndb.url = admin:***@host\nldap.password = ***\n")
+
+	buf := new(bytes.Buffer)
+	_, err := pp.Write(buf, UTF8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), "db.user = admin\ndb.password = ***\ndb.url = ${db.user}:${db.password}@host\nldap.password = ***\n")
+
+	// the original is unchanged
+	assert.Equal(t, p.MustGet("db.url"), "admin:secret@host")
+}
+
+func TestGetLocalizedFloat64(t *testing.T) {
+	p := mustParse(t, "us = 1,000.5\neu = 1.000,5\nplain = 42\nbad = 1,000.5.5\nch = 1'000.25")
+	assert.Equal(t, p.GetLocalizedFloat64("us", '.', ',', 999), 1000.5)
+	assert.Equal(t, p.GetLocalizedFloat64("eu", ',', '.', 999), 1000.5)
+	assert.Equal(t, p.GetLocalizedFloat64("plain", ',', '.', 999), float64(42))
+	assert.Equal(t, p.GetLocalizedFloat64("ch", '.', '\'', 999), 1000.25)
+	assert.Equal(t, p.GetLocalizedFloat64("us", ',', ' ', 999), float64(999))
+	assert.Equal(t, p.GetLocalizedFloat64("bad", '.', ',', 999), float64(999))
+	assert.Equal(t, p.GetLocalizedFloat64("missing", '.', ',', 999), float64(999))
+	assert.Equal(t, p.MustGetLocalizedFloat64("eu", ',', '.'), 1000.5)
+	assert.Panic(t, func() { p.MustGetLocalizedFloat64("bad", '.', ',') }, "strconv.ParseFloat: parsing.*")
+	assert.Panic(t, func() { p.MustGetLocalizedFloat64("missing", '.', ',') }, "unknown property: missing")
+}
+
+func TestIntersect(t *testing.T) {
+	p1 := mustParse(t, "# comment b\nb = 1\na = 2\nc = 3\nd = ${c}")
+	p2 := mustParse(t, "d = x\na = y\ne = z")
+	pp := p1.Intersect(p2)
+	assert.Equal(t, pp.Keys(), []string{"a", "d"})
+	assert.Equal(t, pp.Map(), map[string]string{"a": "2", "d": "${c}"})
+	assert.Equal(t, p1.Len(), 4)
+
+	pp = p2.Intersect(p1)
+	assert.Equal(t, pp.Keys(), []string{"d", "a"})
+	assert.Equal(t, pp.MustGet("a"), "y")
+
+	pp = p1.Intersect(mustParse(t, "b = 0"))
+	assert.Equal(t, pp.Keys(), []string{"b"})
+	assert.Equal(t, pp.GetComment("b"), "comment b")
+	assert.Equal(t, p1.Intersect(NewProperties()).Len(), 0)
+}
+
+func TestGetTemplate(t *testing.T) {
+	p := mustParse(t, "user = frank\ndb.host = h\ngreeting = Hello {{.user}} on {{index . \"db.host\"}}{{.suffix}}\nbad = Hello {{.user\nunknown = {{.nobody}}")
+	s, err := p.GetTemplate("greeting", map[string]interface{}{"suffix": "!"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s, "Hello frank on h!")
+
+	s, err = p.GetTemplate("greeting", map[string]interface{}{"user": "bob", "suffix": ""})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s, "Hello bob on h")
+
+	_, err = p.GetTemplate("bad", nil)
+	assert.Matches(t, err.Error(), "template: bad:1: unclosed action")
+
+	_, err = p.GetTemplate("unknown", nil)
+	assert.Matches(t, err.Error(), "map has no entry for key \"nobody\"")
+
+	_, err = p.GetTemplate("missing", nil)
+	assert.Equal(t, err.Error(), "unknown property: missing")
+}
+
+func TestGetCount(t *testing.T) {
+	tests := []struct {
+		input string
+		value int64
+	}{
+		{"500", 500},
+		{"2k", 2000},
+		{"2K", 2000},
+		{"1m", 1000000},
+		{"3 G", 3000000000},
+		{"-4k", -4000},
+		{"1.5k", 999},
+		{"2x", 999},
+		{"k", 999},
+		{"", 999},
+		{"9223372036854775807k", 999},
+	}
+	for _, test := range tests {
+		p := mustParse(t, "key = "+test.input)
+		assert.Equal(t, p.GetCount("key", 999), test.value, test.input)
+	}
+
+	p := mustParse(t, "key = 2k\nkey2 = 2x\nkey3 = 9223372036854775807k")
+	assert.Equal(t, p.GetCount("missing", 999), int64(999))
+	assert.Equal(t, p.MustGetCount("key"), int64(2000))
+	assert.Panic(t, func() { p.MustGetCount("key2") }, "invalid syntax")
+	assert.Panic(t, func() { p.MustGetCount("key3") }, "out of range")
+	assert.Panic(t, func() { p.MustGetCount("missing") }, "unknown property: missing")
+}
+
+func TestGetWeights(t *testing.T) {
+	p := mustParse(t, "a = 0.2,0.3,0.5\nb = 0.1; 0.2; 0.7\nc = 0.5,0.4\nd = 0.5,x\ne = 1.5,-0.5\nf = 1")
+	def := []float64{1}
+	assert.Equal(t, p.GetWeights("a", ",", def), []float64{0.2, 0.3, 0.5})
+	assert.Equal(t, p.GetWeights("b", ";", def), []float64{0.1, 0.2, 0.7})
+	assert.Equal(t, p.GetWeights("f", ",", nil), []float64{1})
+	assert.Equal(t, p.GetWeights("c", ",", def), def)
+	assert.Equal(t, p.GetWeights("d", ",", def), def)
+	assert.Equal(t, p.GetWeights("e", ",", def), def)
+	assert.Equal(t, p.GetWeights("missing", ",", def), def)
+
+	assert.Equal(t, p.MustGetWeights("a", ","), []float64{0.2, 0.3, 0.5})
+	assert.Panic(t, func() { p.MustGetWeights("c", ",") }, "weights for key c sum up to 0.9 instead of 1")
+	assert.Panic(t, func() { p.MustGetWeights("d", ",") }, `invalid weight "x" for key d`)
+	assert.Panic(t, func() { p.MustGetWeights("e", ",") }, `negative weight "-0.5" for key e`)
+	assert.Panic(t, func() { p.MustGetWeights("missing", ",") }, "unknown property: missing")
+}
+
+func TestClassify(t *testing.T) {
+	p := mustParse(t, "base = 10\nexp = ${base}s\n")
+	for _, test := range []struct {
+		value, kind string
+	}{
+		{"10", "int"},
+		{"-1", "int"},
+		{"3.14", "float"},
+		{"1e3", "float"},
+		{"true", "bool"},
+		{"OFF", "bool"},
+		{"10s", "duration"},
+		{"1h30m", "duration"},
+		{"10MB", "bytes"},
+		{"512b", "bytes"},
+		{"1.5 GiB", "bytes"},
+		{"hello", "string"},
+		{"Inf", "string"},
+		{"", "string"},
+	} {
+		p.MustSet("key", test.value)
+		kind, ok := p.Classify("key")
+		assert.Equal(t, kind, test.kind, test.value)
+		assert.Equal(t, ok, true)
+	}
+
+	kind, ok := p.Classify("exp")
+	assert.Equal(t, kind, "duration")
+	assert.Equal(t, ok, true)
+	kind, ok = p.Classify("missing")
+	assert.Equal(t, kind, "")
+	assert.Equal(t, ok, false)
+}
+
+func TestGetSliceMap(t *testing.T) {
+	p := mustParse(t, "base = /b\nroutes.public = /a, ${base}\nroutes.admin = /x\nroutes.none =\nother = /y")
+	assert.Equal(t, p.GetSliceMap("routes.", ","), map[string][]string{
+		"public": {"/a", "/b"},
+		"admin":  {"/x"},
+		"none":   nil,
+	})
+	assert.Equal(t, p.GetSliceMap("missing.", ","), map[string][]string{})
+}
+
+func TestGetTypedSlice(t *testing.T) {
+	p := mustParse(t, "a = 1,true,3.5,hello\nb = -2; off ;; 10s\nc =")
+	assert.Equal(t, p.GetTypedSlice("a", ","), []interface{}{1, true, 3.5, "hello"})
+	assert.Equal(t, p.GetTypedSlice("b", ";"), []interface{}{-2, false, "10s"})
+	assert.Equal(t, p.GetTypedSlice("c", ","), []interface{}(nil))
+	assert.Equal(t, p.GetTypedSlice("missing", ","), []interface{}(nil))
+}
+
+func TestGetIntSlice(t *testing.T) {
+	p := mustParse(t, "ports = 80,443,8080\nb = 1; -2; 3\nbase = 8000\nc = ${base},x\nempty =")
+	def := []int{80}
+	assert.Equal(t, p.GetIntSlice("ports", ",", def), []int{80, 443, 8080})
+	assert.Equal(t, p.GetIntSlice("b", ";", def), []int{1, -2, 3})
+	assert.Equal(t, p.GetIntSlice("c", ",", def), def)
+	assert.Equal(t, p.GetIntSlice("empty", ",", def), def)
+	assert.Equal(t, p.GetIntSlice("missing", ",", def), def)
+
+	assert.Equal(t, p.MustGetIntSlice("ports", ","), []int{80, 443, 8080})
+	assert.Panic(t, func() { p.MustGetIntSlice("c", ",") }, `invalid int "x" for key c`)
+	assert.Panic(t, func() { p.MustGetIntSlice("missing", ",") }, "unknown property: missing")
+}
+
+func TestGetSIFloat(t *testing.T) {
+	tests := []struct {
+		input string
+		value float64
+	}{
+		{"100k", 100e3},
+		{"2.5M", 2.5e6},
+		{"1.5", 1.5},
+		{"3G", 3e9},
+		{"1T", 1e12},
+		{"5 m", 5e-3},
+		{"10µ", 10e-6},
+		{"10u", 10e-6},
+		{"7n", 7e-9},
+		{"10x", 999},
+		{"k", 999},
+		{"", 999},
+	}
+	for _, test := range tests {
+		p := mustParse(t, "key = "+test.input)
+		assert.Equal(t, p.GetSIFloat("key", 999), test.value, test.input)
+	}
+
+	p := mustParse(t, "key = 2.5M\nkey2 = 10x")
+	assert.Equal(t, p.GetSIFloat("missing", 999), float64(999))
+	assert.Equal(t, p.MustGetSIFloat("key"), 2.5e6)
+	assert.Panic(t, func() { p.MustGetSIFloat("key2") }, "strconv.ParseFloat: parsing.*")
+	assert.Panic(t, func() { p.MustGetSIFloat("missing") }, "unknown property: missing")
+}
+
 // ----------------------------------------------------------------------------
 
 // GOMAXPROCS=1 go test -run='^$' -bench '^BenchmarkMerge$' github.com/magiconair/properties
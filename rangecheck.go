@@ -15,17 +15,37 @@ var is32Bit = ^uint(0) == math.MaxUint32
 // intRangeCheck checks if the value fits into the int type and
 // panics if it does not.
 func intRangeCheck(key string, v int64) int {
+	n, err := intRange(key, v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// intRange checks if the value fits into the int type and
+// returns an error if it does not.
+func intRange(key string, v int64) (int, error) {
 	if is32Bit && (v < math.MinInt32 || v > math.MaxInt32) {
-		panic(fmt.Sprintf("Value %d for key %s out of range", v, key))
+		return 0, fmt.Errorf("Value %d for key %s out of range", v, key)
 	}
-	return int(v)
+	return int(v), nil
 }
 
 // uintRangeCheck checks if the value fits into the uint type and
 // panics if it does not.
 func uintRangeCheck(key string, v uint64) uint {
+	n, err := uintRange(key, v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return n
+}
+
+// uintRange checks if the value fits into the uint type and
+// returns an error if it does not.
+func uintRange(key string, v uint64) (uint, error) {
 	if is32Bit && v > math.MaxUint32 {
-		panic(fmt.Sprintf("Value %d for key %s out of range", v, key))
+		return 0, fmt.Errorf("Value %d for key %s out of range", v, key)
 	}
-	return uint(v)
+	return uint(v), nil
 }
@@ -0,0 +1,37 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"fmt"
+	"time"
+)
+
+// Value returns the expanded value for the given key converted to the type
+// of def. Supported types are string, bool, int, int64, float64 and
+// time.Duration. Durations are parsed with time.ParseDuration(). If the key
+// does not exist or the value cannot be converted the default value is
+// returned. For unsupported types the ErrorHandler is called.
+func Value[T any](p *Properties, key string, def T) T {
+	var v interface{}
+	switch d := interface{}(def).(type) {
+	case string:
+		v = p.GetString(key, d)
+	case bool:
+		v = p.GetBool(key, d)
+	case int:
+		v = p.GetInt(key, d)
+	case int64:
+		v = p.GetInt64(key, d)
+	case float64:
+		v = p.GetFloat64(key, d)
+	case time.Duration:
+		v = p.GetParsedDuration(key, d)
+	default:
+		ErrorHandler(fmt.Errorf("unsupported type %T", def))
+		return def
+	}
+	return v.(T)
+}
@@ -0,0 +1,30 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestValue(t *testing.T) {
+	p := mustParse(t, "s = abc\nb = yes\ni = -3\ni64 = 64\nf = 1.5\nd = 2s\nbad = x")
+	assert.Equal(t, Value(p, "s", "def"), "abc")
+	assert.Equal(t, Value(p, "b", false), true)
+	assert.Equal(t, Value(p, "i", 0), -3)
+	assert.Equal(t, Value(p, "i64", int64(0)), int64(64))
+	assert.Equal(t, Value(p, "f", 0.0), 1.5)
+	assert.Equal(t, Value(p, "d", time.Second), 2*time.Second)
+
+	// missing keys and invalid values return the default
+	assert.Equal(t, Value(p, "missing", "def"), "def")
+	assert.Equal(t, Value(p, "missing", 7), 7)
+	assert.Equal(t, Value(p, "bad", 7), 7)
+	assert.Equal(t, Value(p, "bad", time.Minute), time.Minute)
+
+	assert.Panic(t, func() { Value(p, "i", uint8(0)) }, "unsupported type uint8")
+}
@@ -0,0 +1,73 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+// A View provides access to the keys of a Properties object with a common
+// prefix. All keys passed to a View are transparently prefixed. Values are
+// expanded against all keys of the underlying Properties object.
+type View struct {
+	p      *Properties
+	prefix string
+}
+
+// WithPrefix returns a view on p for all keys with the given prefix.
+// Changes made through the view are visible in p and vice versa.
+func (p *Properties) WithPrefix(prefix string) *View {
+	return &View{p: p, prefix: prefix}
+}
+
+// Prefix returns the prefix of the view.
+func (v *View) Prefix() string {
+	return v.prefix
+}
+
+// Get returns the expanded value for the prefixed key if exists.
+// Otherwise, ok is false.
+func (v *View) Get(key string) (value string, ok bool) {
+	return v.p.Get(v.prefix + key)
+}
+
+// MustGet returns the expanded value for the prefixed key if exists.
+// Otherwise, it panics.
+func (v *View) MustGet(key string) string {
+	return v.p.MustGet(v.prefix + key)
+}
+
+// GetString returns the expanded value for the prefixed key if exists or
+// the default value otherwise.
+func (v *View) GetString(key, def string) string {
+	return v.p.GetString(v.prefix+key, def)
+}
+
+// Set sets the prefixed key to the corresponding value.
+// See Properties.Set for details.
+func (v *View) Set(key, value string) (prev string, ok bool, err error) {
+	return v.p.Set(v.prefix+key, value)
+}
+
+// MustSet sets the prefixed key to the corresponding value.
+// See Properties.MustSet for details.
+func (v *View) MustSet(key, value string) (prev string, ok bool) {
+	return v.p.MustSet(v.prefix+key, value)
+}
+
+// Delete removes the prefixed key and its comments.
+func (v *View) Delete(key string) {
+	v.p.Delete(v.prefix + key)
+}
+
+// Keys returns all keys with the prefix without the prefix in the
+// same order as in the input. The prefix is matched case-insensitively
+// if IgnoreCase is set.
+func (v *View) Keys() []string {
+	v.p.resolve()
+	keys := []string{}
+	for _, k := range v.p.k {
+		if name, ok := v.p.cutPrefix(k, v.prefix); ok && name != "" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,44 @@
+// Copyright 2013-2022 Frank Schroeder. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package properties
+
+import (
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestWithPrefix(t *testing.T) {
+	p := mustParse(t, "domain = example.com\ndb.host = db.${domain}\ndb.port = 5432\nweb.port = 80")
+	v := p.WithPrefix("db.")
+	assert.Equal(t, v.Prefix(), "db.")
+	assert.Equal(t, v.MustGet("host"), "db.example.com")
+	assert.Equal(t, v.GetString("port", ""), "5432")
+	assert.Equal(t, v.GetString("user", "root"), "root")
+	_, ok := v.Get("domain")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, v.Keys(), []string{"host", "port"})
+
+	v.MustSet("user", "admin")
+	assert.Equal(t, p.MustGet("db.user"), "admin")
+	_, _, err := v.Set("port", "${db.port}")
+	assert.Matches(t, err.Error(), "circular reference")
+
+	v.Delete("port")
+	assert.Equal(t, p.Keys(), []string{"domain", "db.host", "web.port", "db.user"})
+	assert.Panic(t, func() { v.MustGet("port") }, "unknown property: db.port")
+}
+
+func TestWithPrefixIgnoreCase(t *testing.T) {
+	l := &Loader{Encoding: UTF8, IgnoreCase: true}
+	p, err := l.LoadBytes([]byte("DB.Host = h\ndb.port = 5432\nweb.port = 80"))
+	assert.Equal(t, err, nil)
+	v := p.WithPrefix("db.")
+	assert.Equal(t, v.Keys(), []string{"Host", "port"})
+	for _, k := range v.Keys() {
+		_, ok := v.Get(k)
+		assert.Equal(t, ok, true, k)
+	}
+}